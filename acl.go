@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// aclRule restricts the domains (with their subdomains) and query types
+// the clients in its networks may query.
+type aclRule struct {
+	Networks []string `mapstructure:"networks"`
+	Domains  []string `mapstructure:"domains"`
+	Qtypes   []string `mapstructure:"qtypes"`
+
+	networks []*net.IPNet
+	domains  *domainTrie
+	qtypes   map[uint16]bool
+}
+
+// parseACL reads the `acl` rules.
+func parseACL() ([]*aclRule, error) {
+	var rules []*aclRule
+	if err := viper.UnmarshalKey("acl", &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if len(rule.Networks) == 0 {
+			return nil, fmt.Errorf("acl rule %d: networks are required", i+1)
+		}
+		for _, cidr := range rule.Networks {
+			ipnet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("acl rule %d: %v", i+1, err)
+			}
+			rule.networks = append(rule.networks, ipnet)
+		}
+		if len(rule.Domains) > 0 {
+			rule.domains = newDomainTrie()
+			for _, domain := range rule.Domains {
+				if _, ok := dns.IsDomainName(domain); !ok {
+					return nil, fmt.Errorf("acl rule %d: invalid domain %q", i+1, domain)
+				}
+				rule.domains.insert(domain)
+			}
+		}
+		if len(rule.Qtypes) > 0 {
+			rule.qtypes = make(map[uint16]bool)
+			for _, name := range rule.Qtypes {
+				qtype, ok := dns.StringToType[strings.ToUpper(name)]
+				if !ok {
+					return nil, fmt.Errorf("acl rule %d: invalid query type %q", i+1, name)
+				}
+				rule.qtypes[qtype] = true
+			}
+		}
+	}
+	return rules, nil
+}
+
+// parseACLAction reports whether unauthorized queries are dropped instead
+// of refused.
+func parseACLAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "", "refused":
+		return false, nil
+	case "drop":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid action %q, expected refused or drop", action)
+}
+
+func (rule *aclRule) matches(ip net.IP) bool {
+	return containsIP(rule.networks, ip)
+}
+
+func (rule *aclRule) permits(q dns.Question) bool {
+	if rule.qtypes != nil && !rule.qtypes[q.Qtype] {
+		return false
+	}
+	return rule.domains == nil || rule.domains.match(q.Name)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range networks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a client.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// authorize reports whether the client at addr may send query q to the
+// listener l: the client must be allowed, and not denied, by the listener,
+// and the first `acl` rule covering its network, if any, must permit q.
+func (cfg *runtimeConfig) authorize(l *listener, addr net.Addr, q dns.Question) bool {
+	ip := addrIP(addr)
+	if l != nil && !l.allowed(addr) {
+		return false
+	}
+	for _, rule := range cfg.acl {
+		if rule.matches(ip) {
+			return rule.permits(q)
+		}
+	}
+	return true
+}
+
+// dropUnauthorized reports whether unauthorized queries to l are dropped,
+// following the listener's acl_action or else the global one.
+func (cfg *runtimeConfig) dropUnauthorized(l *listener) bool {
+	if l != nil && l.ACLAction != "" {
+		return l.aclDrop
+	}
+	return cfg.aclDrop
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestACL(t *testing.T) {
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+records:
+- db.corp. 60 IN A 10.1.2.3
+- db.corp. 60 IN TXT "db"
+- www.example.com. 60 IN A 10.1.2.4
+listeners:
+- address: '127.0.0.1:53'
+  allow: [10.0.0.0/8, 192.168.0.0/16]
+  deny: [10.9.0.0/16]
+- address: '127.0.0.2:53'
+  acl_action: drop
+acl:
+- networks: [192.168.1.0/24]
+  domains: [corp]
+  qtypes: [A, AAAA]
+- networks: [192.168.0.0/16]
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(l *listener, ip, name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}}
+		cfg.resolve(l, w, req)
+		return w.msg
+	}
+	refused := func(m *dns.Msg) bool { return m != nil && m.Rcode == dns.RcodeRefused }
+
+	l := cfg.listener("127.0.0.1:53")
+	tests := []struct {
+		ip      string
+		name    string
+		qtype   uint16
+		refused bool
+	}{
+		{"10.1.2.3", "www.example.com.", dns.TypeA, false},
+		{"10.9.1.1", "db.corp.", dns.TypeA, true},     // denied
+		{"172.16.0.1", "db.corp.", dns.TypeA, true},   // not allowed
+		{"192.168.1.5", "db.corp.", dns.TypeA, false}, // first rule
+		{"192.168.1.5", "db.corp.", dns.TypeTXT, true},
+		{"192.168.1.5", "www.example.com.", dns.TypeA, true},
+		{"192.168.2.5", "www.example.com.", dns.TypeA, false}, // second rule
+	}
+	for _, tt := range tests {
+		m := query(l, tt.ip, tt.name, tt.qtype)
+		if m == nil || refused(m) != tt.refused {
+			t.Errorf("%s %s %s: got %v, want refused %v", tt.ip, tt.name, dns.TypeToString[tt.qtype], m, tt.refused)
+		}
+	}
+
+	// unauthorized queries to the second listener are dropped
+	if m := query(cfg.listener("127.0.0.2:53"), "192.168.1.5", "www.example.com.", dns.TypeA); m != nil {
+		t.Errorf("expected query to be dropped, got %v", m)
+	}
+
+	invalid := []string{
+		"acl: [{domains: [corp]}]\n",
+		"acl: [{networks: [10.0.0.0/33]}]\n",
+		"acl: [{networks: [10.0.0.0/8], qtypes: [BOGUS]}]\n",
+		"acl_action: ignore\n",
+		"listeners: [{address: 127.0.0.1, deny: [bogus]}]\n",
+		"listeners: [{address: 127.0.0.1, acl_action: ignore}]\n",
+	}
+	for _, yamlConfig := range invalid {
+		readTestConfig(t, yamlConfig)
+		if _, err := buildConfig(); err == nil {
+			t.Errorf("expected error for %q", yamlConfig)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+const adminPort = "9153"
+
+// newAdminServer returns the server of the admin listener (`admin_bind`),
+// which exposes the metrics, the runtime status, health checks and the
+// log levels.
+func newAdminServer(ln net.Listener) *httpServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/top", serveTop)
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", serveReadyz)
+	mux.HandleFunc("/loglevel", serveLogLevel)
+	return newHTTPServer(ln, mux)
+}
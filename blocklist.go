@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+const blockTTL = 60
+
+// domainTrie matches a domain name and all of its subdomains. Labels are
+// stored from the root down, so "ads.example.com" is com -> example -> ads.
+type domainTrie struct {
+	children map[string]*domainTrie
+	terminal bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+func (t *domainTrie) insert(domain string) {
+	node := t
+	labels := dns.SplitDomainName(strings.ToLower(domain))
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = newDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+// match reports whether name or one of its parent domains was inserted.
+func (t *domainTrie) match(name string) bool {
+	node := t
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
+
+type blocklist struct {
+	sources   []string
+	allowlist []string
+	refresh   int64 // seconds between reloads, 0 disables refreshing
+	action    string
+	ip        net.IP // answer for the custom IP action
+	stop      chan struct{}
+
+	mu      sync.RWMutex
+	lists   map[string]*listEntries // last good entries of each source
+	blocked *domainTrie
+	allowed *domainTrie
+	size    int
+}
+
+// listEntries are the domains read from one source.
+type listEntries struct {
+	blocked []string
+	allowed []string // adblock exceptions
+}
+
+// parseListLine extracts the domains from a line in plain, hosts or
+// adblock format. Adblock exceptions (@@||domain^) are reported as allowed.
+func parseListLine(line string) (domains []string, allow bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return nil, false
+	}
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	if strings.HasPrefix(line, "@@") {
+		allow = true
+		line = line[2:]
+	}
+	if strings.HasPrefix(line, "||") {
+		// adblock: only plain domain rules are supported, rules with
+		// paths, wildcards or options are skipped
+		end := strings.Index(line, "^")
+		if end < 0 || end != len(line)-1 {
+			return nil, false
+		}
+		line = line[2:end]
+		if strings.ContainsAny(line, "/*") {
+			return nil, false
+		}
+		return []string{line}, allow
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 {
+		// hosts format: "0.0.0.0 domain [domain...]"
+		if net.ParseIP(fields[0]) == nil {
+			return nil, false
+		}
+		fields = fields[1:]
+	}
+	for _, domain := range fields {
+		if domain == "localhost" || domain == "localhost.localdomain" || net.ParseIP(domain) != nil {
+			continue
+		}
+		if _, ok := dns.IsDomainName(domain); ok {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, allow
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func openList(source string) (io.ReadCloser, error) {
+	if isURL(source) {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+// readList returns every domain in r, blocked or, for exceptions, allowed.
+func readList(r io.Reader) (*listEntries, error) {
+	entries := &listEntries{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		domains, allow := parseListLine(scanner.Text())
+		if allow {
+			entries.allowed = append(entries.allowed, domains...)
+		} else {
+			entries.blocked = append(entries.blocked, domains...)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func parseBlockAction(action string) (string, net.IP, error) {
+	switch action = strings.ToLower(action); action {
+	case "nxdomain", "refused", "null":
+		return action, nil, nil
+	}
+	ip := net.ParseIP(action)
+	if ip == nil {
+		return "", nil, fmt.Errorf("invalid block_action %q", action)
+	}
+	return "ip", ip, nil
+}
+
+func newBlocklist() (*blocklist, error) {
+	action, ip, err := parseBlockAction(viper.GetString("block_action"))
+	if err != nil {
+		return nil, err
+	}
+	b := &blocklist{
+		sources:   configStrings("blocklists"),
+		allowlist: configStrings("allowlist"),
+		refresh:   viper.GetInt64("block_refresh"),
+		action:    action,
+		ip:        ip,
+		stop:      make(chan struct{}),
+		lists:     make(map[string]*listEntries),
+	}
+	// local files are read with the configuration, lists from URLs are
+	// downloaded when it's applied and then on every refresh
+	var files []string
+	for _, source := range b.sources {
+		if !isURL(source) {
+			files = append(files, source)
+		}
+	}
+	b.load(files)
+	return b, nil
+}
+
+// keep reuses the lists downloaded by the previous configuration.
+func (b *blocklist) keep(old *blocklist) {
+	old.mu.RLock()
+	b.mu.Lock()
+	for _, source := range b.sources {
+		if entries, ok := old.lists[source]; ok && isURL(source) {
+			b.lists[source] = entries
+		}
+	}
+	b.mu.Unlock()
+	old.mu.RUnlock()
+	b.rebuild()
+}
+
+// load reads sources and rebuilds the block and allow lists. A source that
+// can't be read keeps its last good entries.
+func (b *blocklist) load(sources []string) {
+	for _, source := range sources {
+		r, err := openList(source)
+		if err != nil {
+			configLog.error("error loading blocklist, keeping last entries", "source", source, "error", err)
+			continue
+		}
+		entries, err := readList(r)
+		r.Close()
+		if err != nil {
+			configLog.error("error reading blocklist, keeping last entries", "source", source, "error", err)
+			continue
+		}
+		configLog.info("loaded blocklist", "source", source, "domains", len(entries.blocked))
+		b.mu.Lock()
+		b.lists[source] = entries
+		b.mu.Unlock()
+	}
+	b.rebuild()
+}
+
+// rebuild builds the block and allow lists from the entries of every
+// source.
+func (b *blocklist) rebuild() {
+	blocked, allowed := newDomainTrie(), newDomainTrie()
+	size := 0
+	b.mu.RLock()
+	for _, source := range b.sources {
+		entries, ok := b.lists[source]
+		if !ok {
+			continue
+		}
+		for _, domain := range entries.blocked {
+			blocked.insert(domain)
+		}
+		for _, domain := range entries.allowed {
+			allowed.insert(domain)
+		}
+		size += len(entries.blocked)
+	}
+	b.mu.RUnlock()
+	for _, domain := range b.allowlist {
+		allowed.insert(domain)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked = blocked
+	b.allowed = allowed
+	b.size = size
+}
+
+// missing returns the sources that were never loaded.
+func (b *blocklist) missing() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var sources []string
+	for _, source := range b.sources {
+		if _, ok := b.lists[source]; !ok {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// startRefresh downloads the lists not kept from the previous
+// configuration, then reloads every list every block_refresh seconds so
+// subscriptions pick up upstream changes, until stopRefresh is called.
+func (b *blocklist) startRefresh() {
+	var urls []string
+	for _, source := range b.missing() {
+		if isURL(source) {
+			urls = append(urls, source)
+		}
+	}
+	if len(urls) == 0 && (b.refresh <= 0 || len(b.sources) == 0) {
+		return
+	}
+	go func() {
+		if len(urls) > 0 {
+			b.load(urls)
+		}
+		if b.refresh <= 0 {
+			return
+		}
+		ticker := time.NewTicker(time.Duration(b.refresh) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				b.load(b.sources)
+			}
+		}
+	}()
+}
+
+func (b *blocklist) stopRefresh() {
+	close(b.stop)
+}
+
+// lookup returns the blocked response for req, or nil if the question name
+// is not blocked.
+func (b *blocklist) lookup(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.sources) == 0 || !b.blocked.match(q.Name) || b.allowed.match(q.Name) {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: blockTTL}
+	switch b.action {
+	case "nxdomain":
+		resp.Rcode = dns.RcodeNameError
+	case "refused":
+		resp.Rcode = dns.RcodeRefused
+	case "null":
+		if q.Qtype == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+		} else if q.Qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+		}
+	case "ip":
+		if ip4 := b.ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip4}}
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			resp.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: b.ip}}
+		}
+	}
+	return resp
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseListLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		domain string // space separated
+		allow  bool
+	}{
+		{"ads.example.com", "ads.example.com", false},
+		{"0.0.0.0 tracker.example.com # comment", "tracker.example.com", false},
+		{"127.0.0.1 localhost", "", false},
+		{"0.0.0.0 a.example b.example # comment", "a.example b.example", false},
+		{"127.0.0.1 localhost localhost.localdomain local.example", "local.example", false},
+		{"ads.example.com tracker.example.com", "", false},
+		{"||malware.example.net^", "malware.example.net", false},
+		{"@@||good.example.net^", "good.example.net", true},
+		{"||example.org^$third-party", "", false},
+		{"! adblock comment", "", false},
+		{"# hosts comment", "", false},
+	}
+	for _, test := range tests {
+		domains, allow := parseListLine(test.line)
+		if domain := strings.Join(domains, " "); domain != test.domain || allow != test.allow {
+			t.Errorf("parseListLine(%q) = %q, %v; want %q, %v", test.line, domain, allow, test.domain, test.allow)
+		}
+	}
+}
+
+func TestBlocklistLookup(t *testing.T) {
+	b := &blocklist{sources: []string{"test"}, lists: make(map[string]*listEntries), action: "ip", ip: net.ParseIP("10.0.0.1")}
+	list := "example.com\n||ads.net^\n@@||ok.example.com^\n"
+	entries, err := readList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.lists["test"] = entries
+	b.rebuild()
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp := b.lookup(req)
+	if resp == nil || len(resp.Answer) != 1 || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected custom IP answer, got %v", resp)
+	}
+
+	req.SetQuestion("ok.example.com.", dns.TypeA)
+	if resp := b.lookup(req); resp != nil {
+		t.Errorf("expected allowlisted name to pass, got %v", resp)
+	}
+
+	req.SetQuestion("notads.net.", dns.TypeA)
+	if resp := b.lookup(req); resp != nil {
+		t.Errorf("expected unrelated name to pass, got %v", resp)
+	}
+
+	b.action = "nxdomain"
+	req.SetQuestion("ads.net.", dns.TypeAAAA)
+	if resp := b.lookup(req); resp == nil || resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %v", resp)
+	}
+}
+
+func TestBlocklistURL(t *testing.T) {
+	var hits, failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) != 0 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ads.example.com")
+	}))
+	defer ts.Close()
+
+	readTestConfig(t, "blocklists:\n- "+ts.URL+"\n")
+	b, err := newBlocklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// URLs aren't downloaded while building the configuration
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("list downloaded %d times by newBlocklist", n)
+	}
+	b.startRefresh()
+	defer b.stopRefresh()
+	req := new(dns.Msg)
+	req.SetQuestion("www.ads.example.com.", dns.TypeA)
+	for start := time.Now(); b.lookup(req) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("list not downloaded")
+		}
+	}
+
+	// a failed download keeps the last good entries
+	atomic.StoreInt32(&failing, 1)
+	b.load(b.sources)
+	if b.lookup(req) == nil {
+		t.Error("entries lost after a failed download")
+	}
+
+	// a reload reuses the downloaded list
+	next, err := newBlocklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.keep(b)
+	next.startRefresh()
+	defer next.stopRefresh()
+	if next.lookup(req) == nil {
+		t.Error("downloaded list not kept across reloads")
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("list downloaded %d times, want 2", n)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// runtimeConfig is a snapshot of the runtime configuration. Snapshots are never
+// modified once applied: a reload builds a new one and swaps it atomically,
+// so each query sees a consistent configuration.
+type runtimeConfig struct {
+	listeners  []*listener
+	acl        []*aclRule
+	aclDrop    bool                   // drop unauthorized queries instead of refusing them
+	resolvConf string                 // nameservers_from file
+	canary     string                 // health_canary
+	settings   map[string]interface{} // viper settings it was built from, for /status
+	servers    *nameservers
+	cache      *responseCache
+	records    *localRecords
+	blocker    *blocklist
+	rewrites   []*rewriteRule
+	policies   []*rpzZone
+	dns64      *dns64Config
+	limiter    *rateLimiter
+	queryLog   *queryLog
+	dnstap     *dnstapOutput
+	top        *topStats
+	slowLog    *slowLog
+	tracer     *tracer
+	validator  *validator
+	logging    *logConfig
+}
+
+var (
+	current  atomic.Value // *runtimeConfig
+	configMu sync.Mutex   // guards viper, which isn't safe for concurrent use, and serializes reloads
+)
+
+func getConfig() *runtimeConfig {
+	return current.Load().(*runtimeConfig)
+}
+
+// buildConfig validates the configuration read by viper and builds a new
+// snapshot from it.
+func buildConfig() (*runtimeConfig, error) {
+	if errs := validateConfig(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	cfg := &runtimeConfig{
+		cache:      newResponseCache(),
+		resolvConf: viper.GetString("nameservers_from"),
+		canary:     viper.GetString("health_canary"),
+		settings:   viper.AllSettings(),
+		slowLog:    newSlowLog(),
+	}
+
+	var err error
+	if cfg.listeners, err = parseListeners(); err != nil {
+		return nil, err
+	}
+	if cfg.acl, err = parseACL(); err != nil {
+		return nil, err
+	}
+	if cfg.aclDrop, err = parseACLAction(viper.GetString("acl_action")); err != nil {
+		return nil, fmt.Errorf("acl_action: %v", err)
+	}
+	if cfg.servers, err = buildNameservers(cfg.listeners); err != nil {
+		return nil, err
+	}
+	if cfg.records, err = newLocalRecords(); err != nil {
+		return nil, err
+	}
+	if cfg.rewrites, err = parseRewrites(); err != nil {
+		return nil, err
+	}
+	if cfg.dns64, err = newDNS64Config(); err != nil {
+		return nil, err
+	}
+	if cfg.policies, err = newPolicies(); err != nil {
+		return nil, err
+	}
+	if cfg.blocker, err = newBlocklist(); err != nil {
+		return nil, err
+	}
+	if cfg.limiter, err = newRateLimiter(); err != nil {
+		return nil, err
+	}
+	if cfg.queryLog, err = newQueryLog(); err != nil {
+		return nil, err
+	}
+	if cfg.dnstap, err = newDnstapOutput(); err != nil {
+		return nil, err
+	}
+	if cfg.top, err = newTopStats(); err != nil {
+		return nil, err
+	}
+	if cfg.tracer, err = newTracer(); err != nil {
+		return nil, err
+	}
+	if cfg.validator, err = newValidator(); err != nil {
+		return nil, err
+	}
+	if cfg.logging, err = newLogConfig(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// buildNameservers combines the `nameservers` directive with the servers
+// read from the `nameservers_from` file, if any.
+func buildNameservers(listeners []*listener) (*nameservers, error) {
+	var (
+		nservers []string
+		timeout  time.Duration
+	)
+	seen := make(map[string]bool)
+	add := func(list []string) {
+		for _, ns := range list {
+			if !seen[ns] {
+				seen[ns] = true
+				nservers = append(nservers, ns)
+			}
+		}
+	}
+	add(configStrings("nameservers"))
+	if path := viper.GetString("nameservers_from"); path != "" {
+		list, t, err := resolvConfNameservers(path, listeners)
+		if err != nil {
+			return nil, fmt.Errorf("nameservers_from: %v", err)
+		}
+		add(list)
+		timeout = t
+	}
+	if len(nservers) < 1 {
+		return nil, errors.New("no DNS servers configured")
+	}
+	servers, err := newNameservers(nservers)
+	if err != nil {
+		return nil, err
+	}
+	servers.timeout = timeout
+	return servers, nil
+}
+
+// reloadNameservers rebuilds only the nameservers of the current
+// configuration, keeping everything else.
+func reloadNameservers() {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	old := getConfig()
+	servers, err := buildNameservers(old.listeners)
+	if err != nil {
+		configLog.error("error updating nameservers, keeping current ones", "error", err)
+		return
+	}
+	cfg := *old
+	cfg.servers = servers
+	current.Store(&cfg)
+	pruneUpstreamStats(servers.slist)
+	configLog.info("nameservers updated", "nameservers", servers.slist)
+}
+
+// applyConfig makes cfg the current configuration. The cache is kept when
+// its settings didn't change and only the servers of new listeners are
+// started. If a new listener can't bind, the first configuration fails and
+// later ones keep the current listeners.
+func applyConfig(cfg *runtimeConfig) error {
+	if err := cfg.logging.apply(); err != nil {
+		configLog.error("error opening log, keeping current output", "error", err)
+	}
+	old, _ := current.Load().(*runtimeConfig)
+	var oldQueryLog *queryLog
+	if old != nil {
+		oldQueryLog = old.queryLog
+	}
+	if err := cfg.queryLog.open(oldQueryLog); err != nil {
+		if old == nil {
+			return err
+		}
+		configLog.error("error opening query log, keeping current one", "error", err)
+	}
+	if old != nil && old.cache.sameSettings(cfg.cache) {
+		cfg.cache = old.cache
+	}
+	if old != nil {
+		cfg.limiter.keepBuckets(old.limiter)
+		cfg.dnstap.keep(old.dnstap)
+		cfg.top.keep(old.top)
+		cfg.tracer.keep(old.tracer)
+		cfg.validator.keep(old.validator)
+		cfg.blocker.keep(old.blocker)
+	}
+	// before queries can use them
+	cfg.dnstap.start()
+	cfg.tracer.start()
+	current.Store(cfg)
+	if err := startServers(cfg.listeners); err != nil {
+		if old == nil {
+			return err
+		}
+		serverLog.error("keeping current listeners", "error", err)
+		if err := startServers(old.listeners); err != nil {
+			serverLog.error("error restoring listeners", "error", err)
+		}
+		kept := *cfg
+		kept.listeners = old.listeners
+		cfg = &kept
+		current.Store(cfg)
+	}
+	cfg.dump()
+	pruneUpstreamStats(cfg.servers.slist)
+
+	if old != nil {
+		// listeners may have been kept
+		stopCertWatch(old.listeners)
+	}
+	startPolicies(cfg.policies)
+	cfg.blocker.startRefresh()
+	startCertWatch(cfg.listeners)
+	watchResolvConf(cfg.resolvConf)
+	if old != nil {
+		stopPolicies(old.policies)
+		old.blocker.stopRefresh()
+		old.queryLog.closeSink(cfg.queryLog)
+		old.dnstap.stop(cfg.dnstap)
+		old.tracer.stop(cfg.tracer)
+	}
+	return nil
+}
+
+// readAndReloadConfig reads every configuration source again and rebuilds
+// the configuration from them, all under configMu. On error the current
+// configuration is kept.
+func readAndReloadConfig() {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if err := loadSources(); err != nil {
+		configLog.error("error reading configuration, keeping current one", "error", err)
+		return
+	}
+	cfg, err := buildConfig()
+	if err != nil {
+		configLog.error("invalid configuration, keeping current one", "error", err)
+		return
+	}
+	applyConfig(cfg)
+	configLog.info("configuration reloaded")
+}
+
+// checkConfigFile validates the configuration read by loadConfig,
+// prints the effective configuration including defaults and returns the
+// exit status for -check-config.
+func checkConfigFile(readErr error) int {
+	if readErr != nil {
+		fmt.Fprintln(os.Stderr, "error reading configuration:", readErr)
+		return 1
+	}
+	if file := configFileUsed(); file != "" {
+		fmt.Println("# configuration file:", file)
+	} else {
+		fmt.Println("# no configuration file")
+	}
+	for _, src := range sources[1:] {
+		fmt.Println("#", src.name())
+	}
+	out, err := yaml.Marshal(viper.AllSettings())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error printing configuration:", err)
+		return 1
+	}
+	fmt.Print(string(out))
+
+	errs := validateConfig()
+	if len(errs) == 0 {
+		if _, err := buildConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "configuration OK")
+	return 0
+}
+
+func (cfg *runtimeConfig) dump() {
+	for _, l := range cfg.listeners {
+		configLog.info("listener", "address", l.Address, "transports", l.Transports, "allow", l.Allow, "deny", l.Deny)
+	}
+	for _, rule := range cfg.acl {
+		configLog.info("acl", "networks", rule.Networks, "domains", rule.Domains, "qtypes", rule.Qtypes)
+	}
+	configLog.info("nameservers", "nameservers", cfg.servers.slist, "nameservers_from", cfg.resolvConf)
+	configLog.info("cache", "cache", cfg.cache.on, "negative_cache", cfg.cache.negative, "max_cache_ttl", cfg.cache.maxCacheTTL)
+	configLog.info("blocking", "blocklists", cfg.blocker.sources, "block_action", cfg.blocker.action)
+	configLog.info("dns64", "dns64", cfg.dns64.enabled, "prefix", cfg.dns64.prefix)
+	configLog.info("rate limiting",
+		"rate_limit", viper.GetInt("rate_limit"), "rate_limit_action", limitActionNames[cfg.limiter.queryAction],
+		"rrl", viper.GetInt("rrl"), "rrl_action", limitActionNames[cfg.limiter.rrlAction])
+	configLog.info("query log", "query_log", cfg.queryLog.target, "query_log_sample", cfg.queryLog.sample)
+	configLog.info("dnstap", "dnstap", cfg.dnstap.target)
+	configLog.info("slow query log", "slow_query_log", cfg.slowLog.enabled, "slow_query_ms", viper.GetInt("slow_query_ms"))
+	configLog.info("tracing", "tracing", cfg.tracer.endpoint, "tracing_sample", cfg.tracer.sample)
+	configLog.info("dnssec", "dnssec", cfg.validator.enabled, "trust_anchors", cfg.validator.anchorZones())
+	configLog.info("top lists", "top_size", cfg.top.size, "top_window", cfg.top.window)
+	configLog.info("log", "log_output", cfg.logging.target, "log_level", cfg.logging.level, "log_levels", viper.GetStringSlice("log_levels"))
+	cfg.records.dump()
+	dumpRewrites(cfg.rewrites)
+}
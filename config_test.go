@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func readTestConfig(t *testing.T, yamlConfig string) {
+	viper.Reset()
+	setDefaults()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBufferString(yamlConfig)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildConfig(t *testing.T) {
+	readTestConfig(t, `
+bind: 127.0.0.1
+max_cache_ttl: 60
+nameservers:
+- 8.8.8.8
+records:
+- db.corp. 60 IN A 10.1.2.3
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.listeners[0].Address != "127.0.0.1:53" || cfg.servers.slist[0] != "8.8.8.8:53" || cfg.cache.maxCacheTTL != 60 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	invalid := []string{
+		"bind: 127.0.0.1\n",
+		"nameservers: [8.8.8.8]\nrecords: ['db.corp. IN A nope']\n",
+		"nameservers: [8.8.8.8]\ndns64_prefix: 10.0.0.0/8\n",
+		"nameservers: [8.8.8.8]\nrewrites: [{name: example.com, filter: [NOPE]}]\n",
+	}
+	for _, yamlConfig := range invalid {
+		readTestConfig(t, yamlConfig)
+		if _, err := buildConfig(); err == nil {
+			t.Errorf("expected error for config %q", yamlConfig)
+		}
+	}
+}
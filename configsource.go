@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// configSource is a source of configuration directives. Sources are
+// loaded in order, later sources overriding whole directives of earlier
+// ones.
+type configSource interface {
+	// name identifies the source in logs.
+	name() string
+	// load reads the directives of the source.
+	load() (map[string]interface{}, error)
+	// watch calls changed every time the source is updated.
+	watch(changed func())
+}
+
+var sources []configSource
+
+// loadSources loads every configured source in order and replaces the
+// viper config layer with the result, so flags and environment variables
+// keep taking precedence and directives removed from every source fall
+// back to their defaults. configMu must be held.
+func loadSources() error {
+	settings := make(map[string]interface{})
+	for _, src := range sources {
+		directives, err := src.load()
+		if err != nil {
+			return fmt.Errorf("%s: %v", src.name(), err)
+		}
+		for key, value := range directives {
+			settings[strings.ToLower(key)] = value
+		}
+	}
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	viper.SetConfigType("yaml")
+	return viper.ReadConfig(bytes.NewReader(out))
+}
+
+// configFileUsed returns the configuration file read by the last load, if
+// any.
+func configFileUsed() string {
+	for _, src := range sources {
+		if s, ok := src.(*fileSource); ok {
+			return s.path
+		}
+	}
+	return ""
+}
+
+// watchSources reloads the configuration when any source changes.
+func watchSources() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	for _, src := range sources {
+		src.watch(func() {
+			readAndReloadConfig()
+		})
+	}
+}
+
+// fileSource is the configuration file, found in the config paths or set
+// with -config. It's read with its own viper instance, the global one only
+// holds the merged sources.
+type fileSource struct {
+	v        *viper.Viper
+	optional bool   // a missing file is not an error
+	path     string // file read by the last load
+}
+
+func newFileSource(file string) *fileSource {
+	s := &fileSource{v: viper.New(), optional: file == ""}
+	if file != "" {
+		s.v.SetConfigFile(file)
+	} else {
+		s.v.SetConfigName("lresolver")
+		s.v.AddConfigPath("/etc/lresolver/")
+		s.v.AddConfigPath(".")
+	}
+	return s
+}
+
+func (s *fileSource) name() string {
+	if s.path == "" {
+		return "config file"
+	}
+	return s.path
+}
+
+func (s *fileSource) load() (map[string]interface{}, error) {
+	err := s.v.ReadInConfig()
+	s.path = s.v.ConfigFileUsed()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok && s.optional {
+		// the whole configuration may come from other sources
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.v.AllSettings(), nil
+}
+
+// watch uses its own watcher rather than viper's, which reads the file
+// again outside configMu.
+func (s *fileSource) watch(changed func()) {
+	if s.path == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		configLog.error("error watching", "file", s.path, "error", err)
+		return
+	}
+	// watch the directories to pick up files replaced by rename and
+	// symlinks swapped by Kubernetes config maps
+	name := filepath.Clean(s.path)
+	if err := watcher.Add(filepath.Dir(name)); err != nil {
+		configLog.error("error watching", "file", s.path, "error", err)
+		watcher.Close()
+		return
+	}
+	target, _ := filepath.EvalSymlinks(name)
+	if target != "" && filepath.Dir(target) != filepath.Dir(name) {
+		watcher.Add(filepath.Dir(target))
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				current, _ := filepath.EvalSymlinks(name)
+				file := filepath.Clean(event.Name)
+				written := (file == name || file == target) && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if written || (current != "" && current != target) {
+					if current != target && current != "" && filepath.Dir(current) != filepath.Dir(name) {
+						watcher.Add(filepath.Dir(current))
+					}
+					target = current
+					configLog.info("config file changed", "file", s.path)
+					changed()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				configLog.error("error watching", "file", s.path, "error", err)
+			}
+		}
+	}()
+}
+
+// kvStore is the subset of an etcd-style key/value store used by kvSource.
+type kvStore interface {
+	// list returns every key under prefix with its value, and the store
+	// revision they were read at.
+	list(prefix string) (map[string]string, int64, error)
+	// watch sends on the returned channel every time a key under prefix
+	// changes after revision.
+	watch(prefix string, revision int64) <-chan struct{}
+}
+
+// kvSource reads directives from keys under a prefix of a key/value store.
+// The key relative to the prefix is the directive and the value is parsed
+// as YAML (or JSON). Keys one level deeper are collected in a list, so
+// local records can be managed one per key:
+//
+//	/lresolver/nameservers    = [8.8.8.8, 8.8.4.4]
+//	/lresolver/records/db     = db.corp. 60 IN A 10.1.2.3
+//	/lresolver/rewrites/old   = {name: old-domain.com, to: new-domain.com}
+type kvSource struct {
+	store    kvStore
+	prefix   string
+	revision int64 // store revision read by the last load
+}
+
+func newKVSource(store kvStore, prefix string) *kvSource {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &kvSource{store: store, prefix: prefix}
+}
+
+func (s *kvSource) name() string {
+	return "config store " + s.prefix
+}
+
+// parseKV converts the keys under prefix into directive values.
+func parseKV(prefix string, kv map[string]string) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(kv))
+	for key := range kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	directives := make(map[string]interface{})
+	for _, key := range keys {
+		path := strings.Trim(strings.TrimPrefix(key, prefix), "/")
+		if path == "" {
+			continue
+		}
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(kv[key]), &value); err != nil {
+			return nil, fmt.Errorf("key %s: %v", key, err)
+		}
+		parts := strings.SplitN(path, "/", 2)
+		directive := strings.ToLower(parts[0])
+		if len(parts) == 1 {
+			directives[directive] = value
+			continue
+		}
+		list, _ := directives[directive].([]interface{})
+		directives[directive] = append(list, value)
+	}
+	return directives, nil
+}
+
+func (s *kvSource) load() (map[string]interface{}, error) {
+	kv, revision, err := s.store.list(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	directives, err := parseKV(s.prefix, kv)
+	if err != nil {
+		return nil, err
+	}
+	for key := range directives {
+		if strings.HasPrefix(key, "config_store") {
+			configLog.warn("ignoring key: it can't be set from the store itself", "source", s.name(), "key", key)
+			delete(directives, key)
+		}
+	}
+	s.revision = revision
+	return directives, nil
+}
+
+// watch starts from the revision of the last load, so changes made since
+// then aren't missed.
+func (s *kvSource) watch(changed func()) {
+	changes := s.store.watch(s.prefix, s.revision)
+	go func() {
+		for range changes {
+			configLog.info("config source changed", "source", s.name())
+			changed()
+		}
+	}()
+}
+
+// etcdRetry is how long a broken watch waits before reconnecting.
+var etcdRetry = 5 * time.Second
+
+// etcdStore talks to etcd using the v3 API through its JSON gateway.
+type etcdStore struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// etcdKV is a key/value pair of the gateway, []byte fields are base64 in
+// JSON.
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	Kvs    []etcdKV   `json:"kvs"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest struct {
+		etcdRangeRequest
+		StartRevision int64 `json:"start_revision,omitempty"`
+	} `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header          etcdHeader `json:"header"`
+		Canceled        bool       `json:"canceled"`
+		CompactRevision int64      `json:"compact_revision,string"`
+		Events          []struct {
+			Kv etcdKV `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newEtcdStore(endpoints []string) *etcdStore {
+	return &etcdStore{endpoints: endpoints, client: &http.Client{}}
+}
+
+// prefixRange returns the range of keys under prefix.
+func prefixRange(prefix string) etcdRangeRequest {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return etcdRangeRequest{Key: []byte(prefix), RangeEnd: end[:i+1]}
+		}
+	}
+	// every key from prefix on
+	return etcdRangeRequest{Key: []byte(prefix), RangeEnd: []byte{0}}
+}
+
+// post sends request to the first endpoint that answers. The caller must
+// close the response body.
+func (s *etcdStore) post(path string, request interface{}, timeout time.Duration) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		client := *s.client
+		client.Timeout = timeout
+		resp, err := client.Post(strings.TrimSuffix(endpoint, "/")+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s: unexpected status %s", endpoint, resp.Status)
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no endpoints configured")
+	}
+	return nil, lastErr
+}
+
+func (s *etcdStore) list(prefix string) (map[string]string, int64, error) {
+	resp, err := s.post("/v3/kv/range", prefixRange(prefix), 10*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var r etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, 0, err
+	}
+	kv := make(map[string]string, len(r.Kvs))
+	for _, pair := range r.Kvs {
+		kv[string(pair.Key)] = string(pair.Value)
+	}
+	return kv, r.Header.Revision, nil
+}
+
+func (s *etcdStore) watch(prefix string, revision int64) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		next := revision + 1
+		for {
+			if err := s.watchFrom(prefix, &next, ch); err != nil {
+				configLog.error("error watching config store", "error", err)
+			}
+			time.Sleep(etcdRetry)
+		}
+	}()
+	return ch
+}
+
+// watchFrom watches prefix from revision *next until the stream ends,
+// advancing *next past every change notified on ch.
+func (s *etcdStore) watchFrom(prefix string, next *int64, ch chan<- struct{}) error {
+	var req etcdWatchRequest
+	req.CreateRequest.etcdRangeRequest = prefixRange(prefix)
+	req.CreateRequest.StartRevision = *next
+	resp, err := s.post("/v3/watch", req, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r etcdWatchResponse
+		if err := dec.Decode(&r); err != nil {
+			return err
+		}
+		switch {
+		case r.Error != nil:
+			return errors.New(r.Error.Message)
+		case r.Result.CompactRevision > 0:
+			// the changes since *next are gone, reload everything and
+			// watch from the oldest revision kept
+			*next = r.Result.CompactRevision
+			ch <- struct{}{}
+			return nil
+		case r.Result.Canceled:
+			return errors.New("watch canceled")
+		case len(r.Result.Events) > 0:
+			*next = r.Result.Header.Revision + 1
+			ch <- struct{}{}
+		}
+	}
+}
+
+// newConfigStore returns the key/value store configured with the
+// config_store directives, or nil if none is configured.
+func newConfigStore() (kvStore, error) {
+	switch kind := viper.GetString("config_store"); kind {
+	case "":
+		return nil, nil
+	case "etcd":
+		endpoints := configStrings("config_store_endpoints")
+		if len(endpoints) == 0 {
+			return nil, errors.New("config_store_endpoints is required")
+		}
+		return newEtcdStore(endpoints), nil
+	default:
+		return nil, fmt.Errorf("unsupported config_store %q", kind)
+	}
+}
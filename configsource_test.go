@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// memoryStore is an in-process kvStore for tests.
+type memoryStore struct {
+	mu       sync.Mutex
+	kv       map[string]string
+	revision int64
+	watchers []chan struct{}
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{kv: make(map[string]string)}
+}
+
+func (m *memoryStore) list(prefix string) (map[string]string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kv := make(map[string]string)
+	for key, value := range m.kv {
+		if strings.HasPrefix(key, prefix) {
+			kv[key] = value
+		}
+	}
+	return kv, m.revision, nil
+}
+
+func (m *memoryStore) watch(prefix string, revision int64) <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	m.watchers = append(m.watchers, ch)
+	return ch
+}
+
+func (m *memoryStore) set(key, value string) {
+	m.mu.Lock()
+	if value == "" {
+		delete(m.kv, key)
+	} else {
+		m.kv[key] = value
+	}
+	m.revision++
+	watchers := m.watchers
+	m.mu.Unlock()
+	for _, ch := range watchers {
+		ch <- struct{}{}
+	}
+}
+
+func TestParseKV(t *testing.T) {
+	directives, err := parseKV("/lresolver/", map[string]string{
+		"/lresolver/nameservers":   "[8.8.8.8, 8.8.4.4]",
+		"/lresolver/MAX_CACHE_TTL": "60",
+		"/lresolver/records/b":     "b.corp. 60 IN A 10.0.0.2",
+		"/lresolver/records/a":     "a.corp. 60 IN A 10.0.0.1",
+		"/lresolver/rewrites/old":  "{name: old.com, to: new.com}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(directives["nameservers"]); got != "[8.8.8.8 8.8.4.4]" {
+		t.Errorf("nameservers = %s", got)
+	}
+	if directives["max_cache_ttl"] != 60 {
+		t.Errorf("max_cache_ttl = %v", directives["max_cache_ttl"])
+	}
+	// entries are sorted by key
+	if got := fmt.Sprint(directives["records"]); got != "[a.corp. 60 IN A 10.0.0.1 b.corp. 60 IN A 10.0.0.2]" {
+		t.Errorf("records = %s", got)
+	}
+	if rules, _ := directives["rewrites"].([]interface{}); len(rules) != 1 {
+		t.Errorf("rewrites = %v", directives["rewrites"])
+	}
+
+	if _, err := parseKV("/lresolver/", map[string]string{"/lresolver/tcp": "[oops"}); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
+
+func TestKVSource(t *testing.T) {
+	viper.Reset()
+	setDefaults()
+	bindConfigFlags()
+	f, err := ioutil.TempFile("", "lresolver-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, "nameservers:\n- 8.8.8.8\nmax_cache_ttl: 30\n")
+	f.Close()
+
+	store := newMemoryStore()
+	store.kv["/lresolver/nameservers"] = "1.1.1.1"
+	store.kv["/lresolver/max_cache_ttl"] = "60"
+	store.kv["/lresolver/records/db"] = "db.corp. 60 IN A 10.1.2.3"
+	src := newKVSource(store, "/lresolver")
+	sources = []configSource{newFileSource(f.Name()), src}
+	defer func() { sources = nil }()
+
+	// the environment takes precedence over the store
+	os.Setenv(envName("max_cache_ttl"), "20")
+	defer os.Unsetenv(envName("max_cache_ttl"))
+	if err := loadSources(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the store overrides the file
+	if cfg.servers.slist[0] != "1.1.1.1:53" || cfg.cache.maxCacheTTL != 20 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if len(cfg.records.names["db.corp."]) != 1 {
+		t.Errorf("expected a local record for db.corp., got %v", cfg.records.names)
+	}
+
+	changed := make(chan struct{}, 1)
+	src.watch(func() { changed <- struct{}{} })
+	store.set("/lresolver/nameservers", "")
+	store.set("/lresolver/records/db", "")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+			t.Fatal("no change notified")
+		}
+	}
+	if err := loadSources(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deleted keys fall back to the file, or disappear
+	if cfg.servers.slist[0] != "8.8.8.8:53" {
+		t.Errorf("expected nameservers from file, got %v", cfg.servers.slist)
+	}
+	if len(cfg.records.names) != 0 {
+		t.Errorf("deleted records still set: %v", cfg.records.names)
+	}
+	// and -check-config shows them like any other unset directive
+	out, _ := yaml.Marshal(viper.AllSettings())
+	if strings.Contains(string(out), "null") {
+		t.Errorf("null values in settings:\n%s", out)
+	}
+}
+
+func TestEtcdStoreList(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req etcdRangeRequest
+		if r.URL.Path != "/v3/kv/range" || json.NewDecoder(r.Body).Decode(&req) != nil ||
+			string(req.Key) != "/lresolver/" || string(req.RangeEnd) != "/lresolver0" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"header":{"revision":"42"},"kvs":[
+			{"key":"L2xyZXNvbHZlci90Y3A=","value":"ZmFsc2U=","mod_revision":"7"},
+			{"key":"L2xyZXNvbHZlci9yZWNvcmRzL2Ri","value":"ZGIuY29ycC4gNjAgSU4gQSAxMC4xLjIuMw=="}]}`)
+	}))
+	defer ts.Close()
+
+	store := newEtcdStore([]string{"http://127.0.0.1:1", ts.URL})
+	kv, revision, err := store.list("/lresolver/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 42 {
+		t.Errorf("revision = %d, want 42", revision)
+	}
+	if len(kv) != 2 || kv["/lresolver/tcp"] != "false" || kv["/lresolver/records/db"] != "db.corp. 60 IN A 10.1.2.3" {
+		t.Errorf("unexpected keys %v", kv)
+	}
+}
+
+func TestEtcdStoreWatch(t *testing.T) {
+	starts := make(chan int64, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req etcdWatchRequest
+		if r.URL.Path != "/v3/watch" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		starts <- req.CreateRequest.StartRevision
+		fmt.Fprintln(w, `{"result":{"header":{"revision":"42"},"created":true}}`)
+		fmt.Fprintln(w, `{"result":{"header":{"revision":"43"},"events":[{"kv":{"key":"L2xyZXNvbHZlci90Y3A="}}]}}`)
+		// the stream breaks
+	}))
+	defer ts.Close()
+	defer func(retry time.Duration) { etcdRetry = retry }(etcdRetry)
+	etcdRetry = 10 * time.Millisecond
+
+	store := newEtcdStore([]string{ts.URL})
+	changes := store.watch("/lresolver/", 42)
+	// the watch starts right after the listed revision
+	if start := <-starts; start != 43 {
+		t.Errorf("first watch from %d, want 43", start)
+	}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("no change notified")
+	}
+	// and resumes after the last change seen
+	select {
+	case start := <-starts:
+		if start != 44 {
+			t.Errorf("watch resumed from %d, want 44", start)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch not resumed")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// dns64Config is the DNS64 (RFC 6147) configuration. When enabled, AAAA
+// queries answered with NODATA are synthesized from the A records of the
+// same name using the NAT64 prefix.
+type dns64Config struct {
+	enabled  bool
+	prefix   *net.IPNet
+	exclude4 []*net.IPNet // IPv4 ranges not synthesized
+	exclude6 []*net.IPNet // IPv6 ranges ignored in AAAA answers
+}
+
+// newDNS64Config reads the dns64 directives.
+func newDNS64Config() (*dns64Config, error) {
+	cfg := &dns64Config{enabled: viper.GetBool("dns64")}
+	_, prefix, err := net.ParseCIDR(viper.GetString("dns64_prefix"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns64_prefix: %v", err)
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 {
+		return nil, fmt.Errorf("invalid dns64_prefix %s: not an IPv6 prefix", prefix)
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid dns64_prefix %s: length must be 32, 40, 48, 56, 64 or 96", prefix)
+	}
+	cfg.prefix = prefix
+	for _, cidr := range configStrings("dns64_exclude") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns64_exclude: %v", err)
+		}
+		// kept apart: net.IPNet matches IPv4 addresses against
+		// IPv4-mapped networks like ::ffff:0:0/96 and the other way around
+		if len(network.Mask) == net.IPv4len {
+			cfg.exclude4 = append(cfg.exclude4, network)
+		} else {
+			cfg.exclude6 = append(cfg.exclude6, network)
+		}
+	}
+	return cfg, nil
+}
+
+// ipv4Positions are the byte offsets of the IPv4 address embedded in an
+// IPv6 address for each prefix length (RFC 6052 section 2.2). Byte 8 is
+// always skipped.
+var ipv4Positions = map[int][]int{
+	32: {4, 5, 6, 7},
+	40: {5, 6, 7, 9},
+	48: {6, 7, 9, 10},
+	56: {7, 9, 10, 11},
+	64: {9, 10, 11, 12},
+	96: {12, 13, 14, 15},
+}
+
+func (c *dns64Config) embed(ip4 net.IP) net.IP {
+	ones, _ := c.prefix.Mask.Size()
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, c.prefix.IP)
+	for i, pos := range ipv4Positions[ones] {
+		ip6[pos] = ip4[i]
+	}
+	return ip6
+}
+
+func (c *dns64Config) extract(ip6 net.IP) net.IP {
+	ones, _ := c.prefix.Mask.Size()
+	ip4 := make(net.IP, net.IPv4len)
+	for i, pos := range ipv4Positions[ones] {
+		ip4[i] = ip6[pos]
+	}
+	return ip4
+}
+
+func excluded(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsSynthesis reports whether the upstream response to an AAAA query
+// has no usable AAAA records.
+func (c *dns64Config) needsSynthesis(in *dns.Msg) bool {
+	if in.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range in.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !excluded(c.exclude6, aaaa.AAAA) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesize returns the response to the AAAA query req. If the upstream
+// response in has no AAAA records, the A records of the same name are
+// mapped into the NAT64 prefix; otherwise in is returned.
+func (c *dns64Config) synthesize(servers *nameservers, req, in *dns.Msg, q *queryInfo) *dns.Msg {
+	if !c.enabled || req.Question[0].Qtype != dns.TypeAAAA || !c.needsSynthesis(in) {
+		return in
+	}
+
+	areq := req.Copy()
+	areq.Question[0].Qtype = dns.TypeA
+	ain, err := servers.forward(areq, q)
+	if err != nil || ain.Rcode != dns.RcodeSuccess {
+		return in
+	}
+
+	var answer []dns.RR
+	synthesized := 0
+	for _, rr := range ain.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			answer = append(answer, rr)
+			continue
+		}
+		if excluded(c.exclude4, a.A) {
+			continue
+		}
+		hdr := a.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: c.embed(a.A.To4())})
+		synthesized++
+	}
+	if synthesized == 0 {
+		return in
+	}
+	upstreamLog.debug("dns64: synthesized AAAA records", "name", req.Question[0].Name, "records", synthesized)
+
+	out := new(dns.Msg)
+	out.SetReply(req)
+	out.RecursionAvailable = in.RecursionAvailable
+	out.Answer = answer
+	return out
+}
+
+// ip6ArpaToIP parses a full ip6.arpa name into an IPv6 address.
+func ip6ArpaToIP(name string) net.IP {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".ip6.arpa.") {
+		return nil
+	}
+	nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+	if len(nibbles) != 32 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, nibble := range nibbles {
+		if len(nibble) != 1 {
+			return nil
+		}
+		var v byte
+		switch c := nibble[0]; {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		default:
+			return nil
+		}
+		// nibbles are in reverse order, least significant first
+		pos := 31 - i
+		if pos%2 == 0 {
+			ip[pos/2] |= v << 4
+		} else {
+			ip[pos/2] |= v
+		}
+	}
+	return ip
+}
+
+// resolvePTR answers PTR queries for addresses in the NAT64 prefix with a
+// CNAME to the in-addr.arpa name of the embedded IPv4 address and the
+// upstream answer for it. It returns nil for any other query.
+func (c *dns64Config) resolvePTR(servers *nameservers, req *dns.Msg, qi *queryInfo) *dns.Msg {
+	q := req.Question[0]
+	if !c.enabled || q.Qtype != dns.TypePTR {
+		return nil
+	}
+	ip6 := ip6ArpaToIP(q.Name)
+	if ip6 == nil || !c.prefix.Contains(ip6) {
+		return nil
+	}
+	target, err := dns.ReverseAddr(c.extract(ip6).String())
+	if err != nil {
+		return nil
+	}
+
+	out := new(dns.Msg)
+	out.SetReply(req)
+	out.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}}
+	ptr := new(dns.Msg)
+	ptr.SetQuestion(target, dns.TypePTR)
+	ptr.RecursionDesired = req.RecursionDesired
+	in, err := servers.forward(ptr, qi)
+	if err != nil {
+		out.Rcode = dns.RcodeServerFailure
+		return out
+	}
+	out.Rcode = in.Rcode
+	out.Answer = append(out.Answer, in.Answer...)
+	return out
+}
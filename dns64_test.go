@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNS64EmbedExtract(t *testing.T) {
+	ip4 := net.ParseIP("192.0.2.33").To4()
+	tests := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	}
+	for cidr, want := range tests {
+		_, prefix, _ := net.ParseCIDR(cidr)
+		c := &dns64Config{prefix: prefix}
+		ip6 := c.embed(ip4)
+		if !ip6.Equal(net.ParseIP(want)) {
+			t.Errorf("embed with %s = %s, want %s", cidr, ip6, want)
+		}
+		if back := c.extract(ip6); !back.Equal(ip4) {
+			t.Errorf("extract with %s = %s, want %s", cidr, back, ip4)
+		}
+	}
+}
+
+func TestIP6ArpaToIP(t *testing.T) {
+	ip := net.ParseIP("64:ff9b::c000:221")
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ip6ArpaToIP(name); !got.Equal(ip) {
+		t.Errorf("ip6ArpaToIP(%s) = %s, want %s", name, got, ip)
+	}
+	if got := ip6ArpaToIP("1.0.ip6.arpa."); got != nil {
+		t.Errorf("expected nil for partial name, got %s", got)
+	}
+}
+
+func TestDNS64NeedsSynthesis(t *testing.T) {
+	_, mapped, _ := net.ParseCIDR("::ffff:0:0/96")
+	c := &dns64Config{exclude6: []*net.IPNet{mapped}}
+	in := new(dns.Msg)
+	if !c.needsSynthesis(in) {
+		t.Error("NODATA response should be synthesized")
+	}
+	in.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("::ffff:10.0.0.1")}}
+	if !c.needsSynthesis(in) {
+		t.Error("excluded AAAA records should be ignored")
+	}
+	in.Answer = append(in.Answer, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("2001:db8::1")})
+	if c.needsSynthesis(in) {
+		t.Error("response with AAAA records should not be synthesized")
+	}
+}
+
+func TestDNS64Exclude(t *testing.T) {
+	readTestConfig(t, "dns64_exclude: ['::ffff:0:0/96', 10.0.0.0/8]\n")
+	c, err := newDNS64Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.exclude4) != 1 || len(c.exclude6) != 1 {
+		t.Fatalf("exclude4 = %v, exclude6 = %v", c.exclude4, c.exclude6)
+	}
+	// the IPv4-mapped range only applies to AAAA records
+	if excluded(c.exclude4, net.ParseIP("192.0.2.1").To4()) {
+		t.Error("192.0.2.1 should be synthesized")
+	}
+	if !excluded(c.exclude4, net.ParseIP("10.1.2.3").To4()) {
+		t.Error("10.1.2.3 should not be synthesized")
+	}
+	if !excluded(c.exclude6, net.ParseIP("::ffff:192.0.2.1")) {
+		t.Error("::ffff:192.0.2.1 should be ignored")
+	}
+	// and IPv4 ranges only to A records
+	c.exclude6 = nil
+	in := new(dns.Msg)
+	in.Answer = []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("::ffff:10.1.2.3")}}
+	if c.needsSynthesis(in) {
+		t.Error("IPv4 range applied to AAAA records")
+	}
+}
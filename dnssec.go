@@ -0,0 +1,959 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// root zone KSK-2017 and KSK-2024
+var rootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// longest time a zone trust is cached, whatever the TTL of its records
+	maxTrustTTL = time.Hour
+	// time a zone that failed validation is cached
+	bogusTTL = 30 * time.Second
+	// NSEC3 records with more iterations prove nothing (RFC 9276)
+	nsec3MaxIterations = 150
+)
+
+// algorithms and DS digest types that can be validated: zones signed only
+// with others are insecure (RFC 4035 section 5.2, RFC 6840 section 5.2)
+var (
+	supportedAlgorithms = map[uint8]bool{
+		dns.RSASHA1: true, dns.RSASHA1NSEC3SHA1: true, dns.RSASHA256: true, dns.RSASHA512: true,
+		dns.ECDSAP256SHA256: true, dns.ECDSAP384SHA384: true,
+	}
+	supportedDigests = map[uint8]bool{dns.SHA1: true, dns.SHA256: true, dns.SHA384: true}
+)
+
+// validation states of zones and responses
+const (
+	trustSecure   = "secure"
+	trustInsecure = "insecure"
+	trustBogus    = "bogus"
+)
+
+// zoneTrust is the validation state of a zone: its keys when secure, or
+// why it is bogus.
+type zoneTrust struct {
+	zone   string
+	state  string
+	keys   []*dns.DNSKEY
+	reason error
+	expire time.Time
+}
+
+func bogus(zone string, err error) *zoneTrust {
+	return &zoneTrust{zone: zone, state: trustBogus, reason: err, expire: time.Now().Add(bogusTTL)}
+}
+
+// validator validates upstream responses with DNSSEC (`dnssec`) from the
+// configured trust anchors (`trust_anchors`) and the root zone key, caching
+// the state of the zones it walks through.
+type validator struct {
+	enabled bool
+	anchors map[string][]dns.RR // DS or DNSKEY records by zone
+	zones   *zoneCache
+}
+
+// zoneCache holds the zone states, shared by the validators of successive
+// configurations.
+type zoneCache struct {
+	mu    sync.Mutex
+	zones map[string]*zoneTrust // by name, for names that aren't zone cuts the enclosing zone
+}
+
+func newValidator() (*validator, error) {
+	v := &validator{
+		enabled: viper.GetBool("dnssec"),
+		anchors: make(map[string][]dns.RR),
+		zones:   &zoneCache{zones: make(map[string]*zoneTrust)},
+	}
+	custom := configStrings("trust_anchors")
+	for _, s := range custom {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("trust_anchors: invalid record %q: %v", s, err)
+		}
+		switch a := rr.(type) {
+		case *dns.DS:
+			if !supportedDS(a) {
+				return nil, fmt.Errorf("trust_anchors: %q: unsupported algorithm or digest type", s)
+			}
+		case *dns.DNSKEY:
+			if !supportedAlgorithms[a.Algorithm] {
+				return nil, fmt.Errorf("trust_anchors: %q: unsupported algorithm", s)
+			}
+		default:
+			return nil, fmt.Errorf("trust_anchors: %q is not a DS or DNSKEY record", s)
+		}
+		zone := strings.ToLower(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	if v.anchors["."] == nil {
+		for _, s := range rootAnchors {
+			rr, _ := dns.NewRR(s)
+			v.anchors["."] = append(v.anchors["."], rr)
+		}
+	}
+	return v, nil
+}
+
+// anchorZones returns the zones with a trust anchor.
+func (v *validator) anchorZones() []string {
+	zones := make([]string, 0, len(v.anchors))
+	for zone := range v.anchors {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// keep makes v use the zone states of old when the anchors didn't change.
+func (v *validator) keep(old *validator) {
+	if old.enabled && v.enabled && sameAnchors(old.anchors, v.anchors) {
+		v.zones = old.zones
+	}
+}
+
+func sameAnchors(a, b map[string][]dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for zone, rrs := range a {
+		if len(b[zone]) != len(rrs) {
+			return false
+		}
+		for i, rr := range rrs {
+			if rr.String() != b[zone][i].String() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// exchange forwards req to the nameservers asking for DNSSEC records and
+// validates the response: validated responses get the AD bit and bogus
+// ones are replaced by SERVFAIL. Clients setting CD get the response as is.
+func (v *validator) exchange(servers *nameservers, req *dns.Msg, q *queryInfo) (*dns.Msg, error) {
+	if !v.enabled {
+		return servers.forward(req, q)
+	}
+	up := req.Copy()
+	if opt := up.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		up.SetEdns0(4096, true)
+	}
+	// we validate, not the nameservers
+	up.CheckingDisabled = true
+	in, err := servers.forward(up, q)
+	if err != nil || req.CheckingDisabled {
+		return in, err
+	}
+	in.AuthenticatedData = false
+	if in.Truncated || (in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError) {
+		// validated when the client retries over TCP, or no data to validate
+		return in, nil
+	}
+	state, err := v.validate(servers, up, in)
+	dnssecResults.inc(state)
+	switch state {
+	case trustSecure:
+		in.AuthenticatedData = true
+	case trustBogus:
+		upstreamLog.warn("dnssec: bogus response", "name", req.Question[0].Name, "type", typeString(req.Question[0].Qtype), "error", err)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		return m, nil
+	}
+	return in, nil
+}
+
+// unchecked reports whether req asks for a response not validated (CD).
+func (v *validator) unchecked(req *dns.Msg) bool {
+	return v.enabled && req.CheckingDisabled
+}
+
+// reply adapts a response to the client of req: DNSSEC records are
+// removed unless it set DO, and AD is only kept if it set DO or AD. UDP
+// responses are truncated to the size the client accepts.
+func (v *validator) reply(req, in *dns.Msg, udp bool) *dns.Msg {
+	if !v.enabled {
+		if udp {
+			return truncate(in, udpSize(req))
+		}
+		return in
+	}
+	out := in.Copy()
+	opt := req.IsEdns0()
+	do := opt != nil && opt.Do()
+	out.AuthenticatedData = in.AuthenticatedData && (do || req.AuthenticatedData)
+	if !do {
+		qtype := req.Question[0].Qtype
+		out.Answer = stripDNSSEC(out.Answer, qtype)
+		out.Ns = stripDNSSEC(out.Ns, qtype)
+		out.Extra = stripDNSSEC(out.Extra, qtype)
+	}
+	if opt == nil {
+		// added by exchange
+		extra := out.Extra[:0]
+		for _, rr := range out.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		out.Extra = extra
+	} else if o := out.IsEdns0(); o != nil && !do {
+		o.SetDo(false)
+	}
+	if udp {
+		return truncate(out, udpSize(req))
+	}
+	return out
+}
+
+// udpSize returns the largest UDP response the client of req accepts.
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// truncate returns m if it fits in size bytes, or a copy without the
+// additional records (but OPT) and as many authority and answer records as
+// needed, with TC set if any of these were removed.
+func truncate(m *dns.Msg, size int) *dns.Msg {
+	if m.Len() <= size {
+		return m
+	}
+	out := m.Copy()
+	extra := out.Extra[:0]
+	for _, rr := range out.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	out.Extra = extra
+	for out.Len() > size && len(out.Ns) > 0 {
+		out.Ns, out.Truncated = out.Ns[:len(out.Ns)-1], true
+	}
+	for out.Len() > size && len(out.Answer) > 0 {
+		out.Answer, out.Truncated = out.Answer[:len(out.Answer)-1], true
+	}
+	return out
+}
+
+func stripDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// validate returns whether in, the response to req, is secure, insecure
+// (in an unsigned zone, or not provable) or bogus, with the reason. The
+// answer must follow the CNAME chain from the query name, and answers
+// expanded from a wildcard or missing at the end of the chain need signed
+// proofs of non-existence.
+func (v *validator) validate(servers *nameservers, req, in *dns.Msg) (string, error) {
+	q := req.Question[0]
+	sets, order, sigs := splitRRsets(in.Answer)
+	for _, key := range order {
+		if key.rrtype == dns.TypeDNAME {
+			// the CNAME synthesized from a DNAME isn't signed
+			return trustInsecure, nil
+		}
+	}
+	state := trustSecure
+	name := strings.ToLower(q.Name)
+	used := 0
+	if q.Qtype == dns.TypeANY {
+		for _, key := range order {
+			if key.name != name {
+				continue
+			}
+			used++
+			s, err := v.validateRRset(servers, sets[key], sigs[key], in.Ns)
+			if s == trustBogus {
+				return s, err
+			}
+			if s == trustInsecure {
+				state = trustInsecure
+			}
+		}
+		if used > 0 {
+			name = ""
+		}
+	}
+	for name != "" && used < len(order) {
+		key := rrsetKey{name, q.Qtype}
+		if sets[key] == nil {
+			key.rrtype = dns.TypeCNAME
+		}
+		rrset := sets[key]
+		if rrset == nil {
+			break
+		}
+		used++
+		s, err := v.validateRRset(servers, rrset, sigs[key], in.Ns)
+		if s == trustBogus {
+			return s, err
+		}
+		if s == trustInsecure {
+			state = trustInsecure
+		}
+		name = ""
+		if key.rrtype != q.Qtype {
+			name = strings.ToLower(dns.Fqdn(rrset[0].(*dns.CNAME).Target))
+		}
+	}
+	if used < len(order) {
+		// records off the chain aren't validated
+		state = trustInsecure
+	}
+	if name == "" {
+		return state, nil
+	}
+
+	// no data for the query name or the end of the chain
+	s, err := v.validateDenial(servers, name, q.Qtype, in.Rcode == dns.RcodeNameError, in.Ns)
+	if s == trustSecure {
+		s = state
+	}
+	return s, err
+}
+
+// validateRRset validates an RRset of the answer and, if it was expanded
+// from a wildcard, the proof in ns that its owner doesn't exist.
+func (v *validator) validateRRset(servers *nameservers, rrset []dns.RR, sigs []*dns.RRSIG, ns []dns.RR) (string, error) {
+	owner := strings.ToLower(rrset[0].Header().Name)
+	zt := v.trustFor(servers, signerOf(sigs, owner))
+	if zt.state != trustSecure {
+		return zt.state, zt.reason
+	}
+	sig, err := verifyRRset(rrset, sigs, zt)
+	if err != nil {
+		return trustBogus, err
+	}
+	if int(sig.Labels) >= dns.CountLabel(owner) || strings.HasPrefix(owner, "*.") {
+		return trustSecure, nil
+	}
+
+	// expanded from the wildcard of the closest encloser
+	nsecs, nsec3s, err := signedDenials(ns, zt)
+	if err != nil {
+		return trustBogus, err
+	}
+	encloser := lastLabels(owner, int(sig.Labels))
+	if len(nsec3s) > 0 {
+		if tooManyIterations(nsec3s) {
+			return trustInsecure, nil
+		}
+		nextCloser := lastLabels(owner, int(sig.Labels)+1)
+		for _, n := range nsec3s {
+			if nsec3Covers(n, zt.zone, nextCloser) {
+				return trustSecure, nil
+			}
+		}
+	}
+	for _, n := range nsecs {
+		if nsecCovers(n, owner) && !delegationAbove(n, owner) && nsecEncloser(n, owner) == encloser {
+			return trustSecure, nil
+		}
+	}
+	return trustBogus, fmt.Errorf("%s: wildcard answer without proof that the name doesn't exist", owner)
+}
+
+// validateDenial validates the proof in ns that name doesn't exist
+// (nxdomain) or has no qtype records.
+func (v *validator) validateDenial(servers *nameservers, name string, qtype uint16, nxdomain bool, ns []dns.RR) (string, error) {
+	_, order, sigs := splitRRsets(ns)
+	signer := name
+	for _, key := range order {
+		signer = signerOf(sigs[key], name)
+		break
+	}
+	zt := v.trustFor(servers, signer)
+	if zt.state != trustSecure {
+		return zt.state, zt.reason
+	}
+	nsecs, nsec3s, err := signedDenials(ns, zt)
+	if err != nil {
+		return trustBogus, err
+	}
+	if len(nsec3s) > 0 {
+		return nsec3Denial(nsec3s, zt.zone, name, qtype, nxdomain)
+	}
+	if nsecDenies(nsecs, zt.zone, name, qtype, nxdomain) {
+		return trustSecure, nil
+	}
+	return trustBogus, fmt.Errorf("%s: missing proof of non-existence", name)
+}
+
+// signerOf returns the zone that signed an RRset of name, or name if it
+// isn't signed (or the signer can't have signed it).
+func signerOf(sigs []*dns.RRSIG, name string) string {
+	for _, sig := range sigs {
+		if dns.IsSubDomain(sig.SignerName, name) {
+			return strings.ToLower(sig.SignerName)
+		}
+	}
+	return name
+}
+
+// trustFor returns the state of the zone of name, walking down from the
+// closest trust anchor.
+func (v *validator) trustFor(servers *nameservers, name string) *zoneTrust {
+	name = strings.ToLower(dns.Fqdn(name))
+	anchor, labels := "", -1
+	for zone := range v.anchors {
+		if n := dns.CountLabel(zone); n > labels && dns.IsSubDomain(zone, name) {
+			anchor, labels = zone, n
+		}
+	}
+	if anchor == "" {
+		return &zoneTrust{zone: name, state: trustInsecure}
+	}
+	zt := v.zones.get(anchor)
+	if zt == nil {
+		zt = v.anchorTrust(servers, anchor)
+		v.zones.put(anchor, zt)
+	}
+	parts := dns.SplitDomainName(name)
+	for i := len(parts) - labels - 1; i >= 0 && zt.state == trustSecure; i-- {
+		child := dns.Fqdn(strings.Join(parts[i:], "."))
+		next := v.zones.get(child)
+		if next == nil {
+			next = v.childTrust(servers, zt, child)
+			v.zones.put(child, next)
+		}
+		zt = next
+	}
+	return zt
+}
+
+func (c *zoneCache) get(name string) *zoneTrust {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if zt := c.zones[name]; zt != nil && time.Now().Before(zt.expire) {
+		return zt
+	}
+	return nil
+}
+
+func (c *zoneCache) put(name string, zt *zoneTrust) {
+	c.mu.Lock()
+	c.zones[name] = zt
+	c.mu.Unlock()
+}
+
+// anchorTrust validates the keys of a trust anchor zone.
+func (v *validator) anchorTrust(servers *nameservers, zone string) *zoneTrust {
+	anchors := v.anchors[zone]
+	return v.zoneKeys(servers, zone, time.Now().Add(maxTrustTTL), func(k *dns.DNSKEY) bool {
+		for _, rr := range anchors {
+			switch a := rr.(type) {
+			case *dns.DS:
+				if matchesDS(k, a) {
+					return true
+				}
+			case *dns.DNSKEY:
+				if k.Algorithm == a.Algorithm && k.Flags == a.Flags && k.PublicKey == a.PublicKey {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// childTrust returns the state of child, a name right below the zone of
+// parent: a new zone if it is a signed delegation, insecure if it is an
+// unsigned one, and parent otherwise.
+func (v *validator) childTrust(servers *nameservers, parent *zoneTrust, child string) *zoneTrust {
+	in, err := v.fetch(servers, child, dns.TypeDS)
+	if err != nil {
+		return bogus(child, fmt.Errorf("DS of %s: %v", child, err))
+	}
+	sets, _, sigs := splitRRsets(in.Answer)
+	key := rrsetKey{child, dns.TypeDS}
+	if ds := sets[key]; len(ds) > 0 {
+		if _, err := verifyRRset(ds, sigs[key], parent); err != nil {
+			return bogus(child, err)
+		}
+		expire := expireOf(ds, parent.expire)
+		var usable []*dns.DS
+		for _, rr := range ds {
+			if d := rr.(*dns.DS); supportedDS(d) {
+				usable = append(usable, d)
+			}
+		}
+		if len(usable) == 0 {
+			return &zoneTrust{zone: child, state: trustInsecure, expire: expire}
+		}
+		return v.zoneKeys(servers, child, expire, func(k *dns.DNSKEY) bool {
+			for _, d := range usable {
+				if matchesDS(k, d) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if sets[rrsetKey{child, dns.TypeCNAME}] != nil {
+		// an alias, not a zone cut
+		return parent
+	}
+
+	// no DS: the parent must prove it
+	nsecs, nsec3s, err := signedDenials(in.Ns, parent)
+	if err != nil {
+		return bogus(child, err)
+	}
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return bogus(child, fmt.Errorf("%s: no DS and no signed proof of its absence", child))
+	}
+	expire := expireOf(in.Ns, parent.expire)
+	insecure := &zoneTrust{zone: child, state: trustInsecure, expire: expire}
+	same := &zoneTrust{zone: parent.zone, state: trustSecure, keys: parent.keys, expire: expire}
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, child) {
+			if unsignedDelegation(n.TypeBitMap) {
+				return insecure
+			}
+			return same
+		}
+		if nsecCovers(n, child) && !delegationAbove(n, child) {
+			return same
+		}
+	}
+	if len(nsec3s) > 0 {
+		if tooManyIterations(nsec3s) {
+			return insecure
+		}
+		for _, n := range nsec3s {
+			if nsec3Matches(n, parent.zone, child) {
+				if unsignedDelegation(n.TypeBitMap) {
+					return insecure
+				}
+				return same
+			}
+		}
+		if encloser, optOut := nsec3Encloser(nsec3s, parent.zone, child); encloser != "" {
+			if optOut {
+				// there may be an unsigned delegation
+				return insecure
+			}
+			return same
+		}
+	}
+	return bogus(child, fmt.Errorf("%s: no proof of DS absence", child))
+}
+
+// zoneKeys fetches the DNSKEY records of zone and validates them with the
+// keys that trusted accepts.
+func (v *validator) zoneKeys(servers *nameservers, zone string, expire time.Time, trusted func(*dns.DNSKEY) bool) *zoneTrust {
+	in, err := v.fetch(servers, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return bogus(zone, fmt.Errorf("DNSKEY of %s: %v", zone, err))
+	}
+	sets, _, sigs := splitRRsets(in.Answer)
+	key := rrsetKey{zone, dns.TypeDNSKEY}
+	zt := &zoneTrust{zone: zone, state: trustSecure, expire: expireOf(sets[key], expire)}
+	var all []*dns.DNSKEY
+	for _, rr := range sets[key] {
+		k := rr.(*dns.DNSKEY)
+		if k.Flags&dns.ZONE == 0 {
+			continue
+		}
+		all = append(all, k)
+		if trusted(k) {
+			zt.keys = append(zt.keys, k)
+		}
+	}
+	if len(zt.keys) == 0 {
+		return bogus(zone, fmt.Errorf("%s: no DNSKEY matches the DS or trust anchor", zone))
+	}
+	if _, err := verifyRRset(sets[key], sigs[key], zt); err != nil {
+		return bogus(zone, err)
+	}
+	zt.keys = all
+	return zt
+}
+
+// fetch sends a query of the validator to the nameservers, over TCP if
+// the response is truncated.
+func (v *validator) fetch(servers *nameservers, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	req.CheckingDisabled = true
+	q := &queryInfo{start: time.Now(), req: req, net: "udp"}
+	in, err := servers.forward(req, q)
+	if err == nil && in.Truncated {
+		q.net = "tcp"
+		in, err = servers.forward(req, q)
+	}
+	if err == nil && in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		err = errors.New(rcodeString(in.Rcode))
+	}
+	return in, err
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// splitRRsets groups records in RRsets, in the order they appear, and their
+// signatures.
+func splitRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, []rrsetKey, map[rrsetKey][]*dns.RRSIG) {
+	sets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+	var order []rrsetKey
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		switch h.Rrtype {
+		case dns.TypeRRSIG:
+			sig := rr.(*dns.RRSIG)
+			key := rrsetKey{name, sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		case dns.TypeOPT:
+			continue
+		}
+		key := rrsetKey{name, h.Rrtype}
+		if sets[key] == nil {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+	return sets, order, sigs
+}
+
+// verifyRRset returns the first of sigs that is a valid signature of rrset
+// by a key of zt.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, zt *zoneTrust) (*dns.RRSIG, error) {
+	h := rrset[0].Header()
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%s %s: not signed", h.Name, typeString(h.Rrtype))
+	}
+	now := time.Now()
+	err := fmt.Errorf("no key of %s signed it", zt.zone)
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, zt.zone) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = errors.New("signature expired or not yet valid")
+			continue
+		}
+		for _, k := range zt.keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err = sig.Verify(k, rrset); err == nil {
+				return sig, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s %s: %v", h.Name, typeString(h.Rrtype), err)
+}
+
+func supportedDS(ds *dns.DS) bool {
+	return supportedAlgorithms[ds.Algorithm] && supportedDigests[ds.DigestType]
+}
+
+func matchesDS(k *dns.DNSKEY, ds *dns.DS) bool {
+	if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+		return false
+	}
+	d := k.ToDS(ds.DigestType)
+	return d != nil && strings.EqualFold(d.Digest, ds.Digest)
+}
+
+// signedDenials returns the NSEC and NSEC3 records of the zone of zt in
+// ns, once their signatures are verified.
+func signedDenials(ns []dns.RR, zt *zoneTrust) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	sets, order, sigs := splitRRsets(ns)
+	var (
+		nsecs  []*dns.NSEC
+		nsec3s []*dns.NSEC3
+	)
+	for _, key := range order {
+		if (key.rrtype != dns.TypeNSEC && key.rrtype != dns.TypeNSEC3) || !dns.IsSubDomain(zt.zone, key.name) {
+			continue
+		}
+		if _, err := verifyRRset(sets[key], sigs[key], zt); err != nil {
+			return nil, nil, err
+		}
+		for _, rr := range sets[key] {
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, n)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, n)
+			}
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// nsecDenies reports whether nsecs prove that name doesn't exist
+// (nxdomain), and that no wildcard could have matched it, or that name or
+// the wildcard matching it have no qtype records (RFC 4035 section 5.4).
+func nsecDenies(nsecs []*dns.NSEC, zone, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if strings.EqualFold(n.Hdr.Name, name) {
+				return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+	for _, n := range nsecs {
+		if !nsecCovers(n, name) || delegationAbove(n, name) {
+			continue
+		}
+		encloser := nsecEncloser(n, name)
+		if !dns.IsSubDomain(zone, encloser) {
+			continue
+		}
+		wildcard := wildcardOf(encloser)
+		for _, w := range nsecs {
+			if nxdomain && nsecCovers(w, wildcard) {
+				return true
+			}
+			if !nxdomain && strings.EqualFold(w.Hdr.Name, wildcard) &&
+				!hasType(w.TypeBitMap, qtype) && !hasType(w.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Denial returns whether nsec3s prove that name doesn't exist
+// (nxdomain) or that name or the wildcard matching it have no qtype records
+// (RFC 5155 section 8). Proofs relying on opt-out are insecure.
+func nsec3Denial(nsec3s []*dns.NSEC3, zone, name string, qtype uint16, nxdomain bool) (string, error) {
+	if tooManyIterations(nsec3s) {
+		return trustInsecure, nil
+	}
+	if !nxdomain {
+		for _, n := range nsec3s {
+			if nsec3Matches(n, zone, name) {
+				if hasType(n.TypeBitMap, qtype) || hasType(n.TypeBitMap, dns.TypeCNAME) {
+					return trustBogus, fmt.Errorf("%s: NSEC3 shows the type exists", name)
+				}
+				return trustSecure, nil
+			}
+		}
+	}
+	encloser, optOut := nsec3Encloser(nsec3s, zone, name)
+	if encloser == "" {
+		return trustBogus, fmt.Errorf("%s: no closest encloser proof", name)
+	}
+	if optOut {
+		// an unsigned delegation may hold the name
+		return trustInsecure, nil
+	}
+	wildcard := wildcardOf(encloser)
+	for _, n := range nsec3s {
+		if nxdomain && nsec3Covers(n, zone, wildcard) {
+			return trustSecure, nil
+		}
+		if !nxdomain && nsec3Matches(n, zone, wildcard) &&
+			!hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME) {
+			return trustSecure, nil
+		}
+	}
+	return trustBogus, fmt.Errorf("%s: no proof that the wildcard %s doesn't match", name, wildcard)
+}
+
+// nsec3Encloser returns the closest encloser of name proven by nsec3s: the
+// closest ancestor with a matching NSEC3 whose child towards name, the next
+// closer name, is covered by another (RFC 5155 section 8.3), and whether
+// that NSEC3 is opt-out.
+func nsec3Encloser(nsec3s []*dns.NSEC3, zone, name string) (string, bool) {
+	labels := dns.CountLabel(name)
+	for n := labels - 1; n >= dns.CountLabel(zone); n-- {
+		encloser := lastLabels(name, n)
+		matched := false
+		for _, rr := range nsec3s {
+			if nsec3Matches(rr, zone, encloser) {
+				if unsignedDelegation(rr.TypeBitMap) || hasType(rr.TypeBitMap, dns.TypeDNAME) ||
+					(hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)) {
+					// the names below are in another zone
+					return "", false
+				}
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		nextCloser := lastLabels(name, n+1)
+		for _, rr := range nsec3s {
+			if nsec3Covers(rr, zone, nextCloser) {
+				return encloser, rr.Flags&1 == 1
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// nsec3Hashes returns the hash n is the owner of and the hash of name with
+// the parameters of n, if n is an NSEC3 record of zone with a known hash.
+func nsec3Hashes(n *dns.NSEC3, zone, name string) (string, string, bool) {
+	labels := dns.SplitDomainName(n.Hdr.Name)
+	if len(labels) < 1 || !strings.EqualFold(lastLabels(n.Hdr.Name, len(labels)-1), zone) {
+		return "", "", false
+	}
+	hash := dns.HashName(name, n.Hash, n.Iterations, n.Salt)
+	return strings.ToUpper(labels[0]), hash, hash != ""
+}
+
+func nsec3Matches(n *dns.NSEC3, zone, name string) bool {
+	owner, hash, ok := nsec3Hashes(n, zone, name)
+	return ok && owner == hash
+}
+
+// nsec3Covers reports whether the hash of name falls between the owner and
+// the next hash of n.
+func nsec3Covers(n *dns.NSEC3, zone, name string) bool {
+	owner, hash, ok := nsec3Hashes(n, zone, name)
+	if !ok {
+		return false
+	}
+	next := strings.ToUpper(n.NextDomain)
+	if owner < next {
+		return owner < hash && hash < next
+	}
+	// the last NSEC3 of the zone
+	return hash > owner || hash < next
+}
+
+// tooManyIterations reports whether nsec3s use more iterations than
+// validators have to compute (RFC 9276 section 3.2).
+func tooManyIterations(nsec3s []*dns.NSEC3) bool {
+	for _, n := range nsec3s {
+		if n.Iterations > nsec3MaxIterations {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecEncloser returns the closest encloser of name when n covers it: the
+// longest ancestor it shares with the owner or the next name of n.
+func nsecEncloser(n *dns.NSEC, name string) string {
+	name = strings.ToLower(name)
+	common := dns.CompareDomainName(name, strings.ToLower(n.Hdr.Name))
+	if c := dns.CompareDomainName(name, strings.ToLower(n.NextDomain)); c > common {
+		common = c
+	}
+	return lastLabels(name, common)
+}
+
+// delegationAbove reports whether n is at a zone cut above name, where the
+// names below belong to another zone.
+func delegationAbove(n *dns.NSEC, name string) bool {
+	if strings.EqualFold(n.Hdr.Name, name) || !dns.IsSubDomain(n.Hdr.Name, name) {
+		return false
+	}
+	return hasType(n.TypeBitMap, dns.TypeDNAME) ||
+		(hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA))
+}
+
+func unsignedDelegation(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) && !hasType(bitmap, dns.TypeDS)
+}
+
+// lastLabels returns the ancestor of name with n labels.
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n <= 0 {
+		return "."
+	}
+	if n >= len(labels) {
+		return strings.ToLower(dns.Fqdn(name))
+	}
+	return strings.ToLower(dns.Fqdn(strings.Join(labels[len(labels)-n:], ".")))
+}
+
+func wildcardOf(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+// nsecCovers reports whether name falls between the owner and the next
+// name of n in canonical order.
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of the zone
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare compares domain names in DNSSEC canonical order
+// (RFC 4034 section 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// expireOf returns when records with rrs TTLs expire, no later than max.
+func expireOf(rrs []dns.RR, max time.Time) time.Time {
+	expire := time.Now().Add(maxTrustTTL)
+	for _, rr := range rrs {
+		if t := time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second); t.Before(expire) {
+			expire = t
+		}
+	}
+	if max.Before(expire) {
+		return max
+	}
+	return expire
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signedZone is a zone signed with one key.
+type signedZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newSignedZone(t *testing.T, name string) *signedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signedZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *signedZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+// stubResponse is the response of the signed nameserver of the tests.
+type stubResponse struct {
+	answer, ns []dns.RR
+	rcode      int
+	truncated  bool // over UDP
+}
+
+func TestDNSSEC(t *testing.T) {
+	top := newSignedZone(t, "test.")
+	sub := newSignedZone(t, "sub.test.")
+	n3 := newSignedZone(t, "n3.test.")
+	ds := func(z *signedZone) dns.RR {
+		d := z.key.ToDS(dns.SHA256)
+		d.Hdr.Ttl = 3600
+		return d
+	}
+	// answers synthesized from a wildcard
+	expand := func(rrs []dns.RR, name string) []dns.RR {
+		var out []dns.RR
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			out = append(out, rr)
+		}
+		return out
+	}
+	nsec3 := func(name, next string, optOut bool, types ...uint16) dns.RR {
+		n := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: dns.HashName(name, dns.SHA1, 0, "") + ".n3.test.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			NextDomain: dns.HashName(next, dns.SHA1, 0, ""),
+			TypeBitMap: types,
+		}
+		if optOut {
+			n.Flags = 1
+		}
+		return n
+	}
+	join := func(sets ...[]dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, rrs := range sets {
+			out = append(out, rrs...)
+		}
+		return out
+	}
+
+	// changed after it was signed
+	bad := sub.sign(t, mustRR(t, "bad.sub.test. 60 IN A 192.0.2.2"))
+	bad[0].(*dns.A).A = net.ParseIP("192.0.2.66")
+
+	// sub.test. has the names bad, unsigned, *.w and www, with NSEC
+	soa := sub.sign(t, mustRR(t, "sub.test. 60 IN SOA ns.sub.test. admin.sub.test. 1 3600 600 86400 60"))
+	nsecApex := sub.sign(t, mustRR(t, "sub.test. 60 IN NSEC bad.sub.test. NS SOA RRSIG NSEC DNSKEY"))
+	nsecBad := sub.sign(t, mustRR(t, "bad.sub.test. 60 IN NSEC unsigned.sub.test. A RRSIG NSEC"))
+	nsecUnsigned := sub.sign(t, mustRR(t, "unsigned.sub.test. 60 IN NSEC *.w.sub.test. A RRSIG NSEC"))
+	nsecWild := sub.sign(t, mustRR(t, "*.w.sub.test. 60 IN NSEC www.sub.test. A RRSIG NSEC"))
+	nsecWww := sub.sign(t, mustRR(t, "www.sub.test. 60 IN NSEC sub.test. A RRSIG NSEC"))
+	www := sub.sign(t, mustRR(t, "www.sub.test. 60 IN A 192.0.2.1"))
+	wild := sub.sign(t, mustRR(t, "*.w.sub.test. 60 IN A 192.0.2.7"))
+
+	// n3.test. has the names n3.test. and www, with NSEC3
+	n3Apex := n3.sign(t, nsec3("n3.test.", "www.n3.test.", false, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM))
+	n3Www := n3.sign(t, nsec3("www.n3.test.", "n3.test.", false, dns.TypeA, dns.TypeRRSIG))
+	n3ApexOptOut := n3.sign(t, nsec3("n3.test.", "www.n3.test.", true, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM))
+	n3WwwOptOut := n3.sign(t, nsec3("www.n3.test.", "n3.test.", true, dns.TypeA, dns.TypeRRSIG))
+
+	// too large for clients without EDNS
+	var txt []dns.RR
+	for i := 0; i < 20; i++ {
+		txt = append(txt, mustRR(t, fmt.Sprintf("big.sub.test. 60 IN TXT \"record %02d of a response that doesn't fit in 512 bytes\"", i)))
+	}
+
+	type key struct {
+		name  string
+		qtype uint16
+	}
+	nxdomain := dns.RcodeNameError
+	responses := map[key]stubResponse{
+		{"test.", dns.TypeDNSKEY}:      {answer: top.sign(t, top.key)},
+		{"sub.test.", dns.TypeDS}:      {answer: top.sign(t, ds(sub))},
+		{"sub.test.", dns.TypeDNSKEY}:  {answer: sub.sign(t, sub.key)},
+		{"n3.test.", dns.TypeDS}:       {answer: top.sign(t, ds(n3))},
+		{"n3.test.", dns.TypeDNSKEY}:   {answer: n3.sign(t, n3.key)},
+		{"insecure.test.", dns.TypeDS}: {ns: top.sign(t, mustRR(t, "insecure.test. 60 IN NSEC n3.test. NS RRSIG NSEC"))},
+		// Ed25519 and GOST digests can't be validated
+		{"ed.test.", dns.TypeDS}:           {answer: top.sign(t, mustRR(t, "ed.test. 3600 IN DS 3613 15 2 3AA5AB37EFCE57F737FC1627013FEE07BDF241BD10F3B1964AB55C78E79A304B"))},
+		{"gost.test.", dns.TypeDS}:         {answer: top.sign(t, mustRR(t, "gost.test. 3600 IN DS 3613 13 3 3AA5AB37EFCE57F737FC1627013FEE07BDF241BD10F3B1964AB55C78E79A304B"))},
+		{"unsigned.sub.test.", dns.TypeDS}: {ns: join(soa, nsecUnsigned)},
+		{"offchain.sub.test.", dns.TypeDS}: {ns: join(soa, nsecBad)},
+
+		{"www.sub.test.", dns.TypeA}:      {answer: www},
+		{"www.sub.test.", dns.TypeAAAA}:   {ns: join(soa, nsecWww)},
+		{"bad.sub.test.", dns.TypeA}:      {answer: bad},
+		{"unsigned.sub.test.", dns.TypeA}: {answer: []dns.RR{mustRR(t, "unsigned.sub.test. 60 IN A 192.0.2.4")}},
+		{"www.insecure.test.", dns.TypeA}: {answer: []dns.RR{mustRR(t, "www.insecure.test. 60 IN A 192.0.2.3")}},
+		{"www.ed.test.", dns.TypeA}:       {answer: []dns.RR{mustRR(t, "www.ed.test. 60 IN A 192.0.2.5")}},
+		{"www.gost.test.", dns.TypeA}:     {answer: []dns.RR{mustRR(t, "www.gost.test. 60 IN A 192.0.2.6")}},
+		{"nx.sub.test.", dns.TypeA}:       {ns: join(soa, nsecBad, nsecApex), rcode: nxdomain},
+		// no proof that *.sub.test. doesn't exist
+		{"nx2.sub.test.", dns.TypeA}:     {ns: join(soa, nsecBad), rcode: nxdomain},
+		{"any.w.sub.test.", dns.TypeA}:   {answer: expand(wild, "any.w.sub.test."), ns: nsecWild},
+		{"any.w.sub.test.", dns.TypeMX}:  {ns: join(soa, nsecWild)},
+		{"other.w.sub.test.", dns.TypeA}: {answer: expand(wild, "other.w.sub.test.")},
+		{"alias.sub.test.", dns.TypeA}:   {answer: join(sub.sign(t, mustRR(t, "alias.sub.test. 60 IN CNAME www.sub.test.")), www)},
+		{"dangling.sub.test.", dns.TypeA}: {
+			answer: sub.sign(t, mustRR(t, "dangling.sub.test. 60 IN CNAME nx.sub.test.")),
+			ns:     join(soa, nsecBad, nsecApex),
+			rcode:  nxdomain,
+		},
+		{"offchain.sub.test.", dns.TypeA}: {answer: www},
+		{"big.sub.test.", dns.TypeTXT}:    {answer: sub.sign(t, txt...), truncated: true},
+
+		{"www.n3.test.", dns.TypeA}:    {answer: n3.sign(t, mustRR(t, "www.n3.test. 60 IN A 192.0.2.8"))},
+		{"www.n3.test.", dns.TypeAAAA}: {ns: n3Www},
+		{"www.n3.test.", dns.TypeMX}:   {ns: n3Apex},
+		{"nx.n3.test.", dns.TypeA}:     {ns: join(n3Apex, n3Www), rcode: nxdomain},
+		// no closest encloser
+		{"nx2.n3.test.", dns.TypeA}:    {ns: n3Www, rcode: nxdomain},
+		{"optout.n3.test.", dns.TypeA}: {ns: join(n3ApexOptOut, n3WwwOptOut), rcode: nxdomain},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if resp, ok := responses[key{q.Name, q.Qtype}]; ok {
+			m.Answer, m.Ns, m.Rcode = resp.answer, resp.ns, resp.rcode
+			if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && resp.truncated {
+				m.Answer, m.Ns, m.Truncated = nil, nil, true
+			}
+		} else {
+			m.Rcode = dns.RcodeRefused
+		}
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("query %s %s without DO", q.Name, typeString(q.Qtype))
+		}
+		m.SetEdns0(4096, true)
+		w.WriteMsg(m)
+	})
+	for _, upstream := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: ln, Handler: handler}} {
+		go upstream.ActivateAndServe()
+		defer upstream.Shutdown()
+	}
+
+	readTestConfig(t, `
+nameservers: ["`+pc.LocalAddr().String()+`"]
+dnssec: true
+trust_anchors: ["`+top.key.String()+`"]
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bogusBefore := dnssecResults.get(trustBogus)
+
+	query := func(remote net.Addr, name string, qtype uint16, do, ad, cd bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.AuthenticatedData, req.CheckingDisabled = ad, cd
+		if do {
+			req.SetEdns0(4096, true)
+		}
+		w := &dohResponseWriter{remote: remote}
+		cfg.resolve(nil, w, req)
+		if w.msg == nil {
+			t.Fatalf("%s: no response", name)
+		}
+		return w.msg
+	}
+	resolve := func(name string, qtype uint16, do, ad, cd bool) *dns.Msg {
+		return query(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, name, qtype, do, ad, cd)
+	}
+	hasSigs := func(m *dns.Msg) bool {
+		for _, rr := range append(m.Answer, m.Ns...) {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	servfail := dns.RcodeServerFailure
+	tests := []struct {
+		name       string
+		qtype      uint16
+		do, ad, cd bool
+		rcode      int
+		authentic  bool
+	}{
+		{"www.sub.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, true},
+		// from the cache
+		{"www.sub.test.", dns.TypeA, false, false, false, dns.RcodeSuccess, false},
+		{"www.sub.test.", dns.TypeA, false, true, false, dns.RcodeSuccess, true},
+		{"www.insecure.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, false},
+		{"www.ed.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, false},
+		{"www.gost.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, false},
+		{"bad.sub.test.", dns.TypeA, true, false, false, servfail, false},
+		{"unsigned.sub.test.", dns.TypeA, true, false, false, servfail, false},
+		{"bad.sub.test.", dns.TypeA, true, false, true, dns.RcodeSuccess, false},
+
+		// NSEC
+		{"www.sub.test.", dns.TypeAAAA, true, false, false, dns.RcodeSuccess, true},
+		{"nx.sub.test.", dns.TypeA, true, false, false, nxdomain, true},
+		{"nx2.sub.test.", dns.TypeA, true, false, false, servfail, false},
+		{"any.w.sub.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, true},
+		{"any.w.sub.test.", dns.TypeMX, true, false, false, dns.RcodeSuccess, true},
+		{"other.w.sub.test.", dns.TypeA, true, false, false, servfail, false},
+
+		// CNAME chains
+		{"alias.sub.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, true},
+		{"dangling.sub.test.", dns.TypeA, true, false, false, nxdomain, true},
+		{"offchain.sub.test.", dns.TypeA, true, false, false, servfail, false},
+
+		// NSEC3
+		{"www.n3.test.", dns.TypeA, true, false, false, dns.RcodeSuccess, true},
+		{"www.n3.test.", dns.TypeAAAA, true, false, false, dns.RcodeSuccess, true},
+		{"www.n3.test.", dns.TypeMX, true, false, false, servfail, false},
+		{"nx.n3.test.", dns.TypeA, true, false, false, nxdomain, true},
+		{"nx2.n3.test.", dns.TypeA, true, false, false, servfail, false},
+		{"optout.n3.test.", dns.TypeA, true, false, false, nxdomain, false},
+	}
+	bogus := 0
+	for _, test := range tests {
+		m := resolve(test.name, test.qtype, test.do, test.ad, test.cd)
+		qtype := typeString(test.qtype)
+		if m.Rcode != test.rcode || m.AuthenticatedData != test.authentic {
+			t.Errorf("%s %s (do %v, ad %v, cd %v): got %s, AD %v; want %s, AD %v", test.name, qtype, test.do, test.ad, test.cd,
+				rcodeString(m.Rcode), m.AuthenticatedData, rcodeString(test.rcode), test.authentic)
+		}
+		if (!test.do && hasSigs(m)) || (test.do && test.authentic && !hasSigs(m)) {
+			t.Errorf("%s %s (do %v): RRSIG records returned: %v", test.name, qtype, test.do, hasSigs(m))
+		}
+		if !test.do && m.IsEdns0() != nil {
+			t.Errorf("%s %s: OPT record returned to a client without EDNS", test.name, qtype)
+		}
+		if test.rcode == servfail {
+			bogus++
+		}
+	}
+	if n := dnssecResults.get(trustBogus) - bogusBefore; int(n) != bogus {
+		t.Errorf("%v bogus responses counted, want %d", n, bogus)
+	}
+
+	// truncated over UDP, not cached, and validated when retried over TCP
+	if m := resolve("big.sub.test.", dns.TypeTXT, true, false, false); !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("big.sub.test. TXT over UDP: got TC %v and %d records, want a truncated response", m.Truncated, len(m.Answer))
+	}
+	m := query(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, "big.sub.test.", dns.TypeTXT, true, false, false)
+	if m.Truncated || !m.AuthenticatedData || len(m.Answer) != len(txt)+1 {
+		t.Errorf("big.sub.test. TXT over TCP: got TC %v, AD %v and %d records; want %d validated records", m.Truncated, m.AuthenticatedData, len(m.Answer), len(txt)+1)
+	}
+	// from the cache, too large for a client without EDNS
+	if m := resolve("big.sub.test.", dns.TypeTXT, false, false, false); !m.Truncated || m.Len() > dns.MinMsgSize {
+		t.Errorf("big.sub.test. TXT over UDP without EDNS: got TC %v and %d bytes", m.Truncated, m.Len())
+	}
+	if m := resolve("big.sub.test.", dns.TypeTXT, true, false, false); m.Truncated || !m.AuthenticatedData {
+		t.Errorf("big.sub.test. TXT over UDP with EDNS: got TC %v, AD %v", m.Truncated, m.AuthenticatedData)
+	}
+
+	if zones := strings.Join(cfg.validator.anchorZones(), " "); zones != ". test." {
+		t.Errorf("trust anchors for %q, want the root and test.", zones)
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	n := &dns.NSEC{Hdr: dns.RR_Header{Name: "b.example."}, NextDomain: "d.example."}
+	last := &dns.NSEC{Hdr: dns.RR_Header{Name: "z.example."}, NextDomain: "example."}
+	for _, test := range []struct {
+		nsec   *dns.NSEC
+		name   string
+		covers bool
+	}{
+		{n, "c.example.", true},
+		{n, "x.b.example.", true},
+		{n, "B.example.", false},
+		{n, "d.example.", false},
+		{n, "a.example.", false},
+		{last, "zz.example.", true},
+		{last, "a.z.example.", true},
+		{last, "a.example.", false},
+	} {
+		if got := nsecCovers(test.nsec, test.name); got != test.covers {
+			t.Errorf("%s covers %s: got %v", test.nsec.Hdr.Name, test.name, got)
+		}
+	}
+}
+
+func TestValidatorKeep(t *testing.T) {
+	readTestConfig(t, `
+nameservers: ["127.0.0.1:1"]
+dnssec: true
+`)
+	old, err := newValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := newValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.keep(old)
+	if v.zones != old.zones {
+		t.Fatal("zone states not kept")
+	}
+	// queries of both configurations during a reload
+	var wg sync.WaitGroup
+	for _, val := range []*validator{old, v} {
+		wg.Add(1)
+		go func(val *validator) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("z%d.test.", i)
+				val.zones.put(name, &zoneTrust{zone: name, state: trustInsecure, expire: time.Now().Add(time.Minute)})
+				val.zones.get(name)
+			}
+		}(val)
+	}
+	wg.Wait()
+
+	readTestConfig(t, `
+nameservers: ["127.0.0.1:1"]
+dnssec: true
+trust_anchors: ["test. IN DS 12345 13 2 3F1E"]
+`)
+	changed, err := newValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed.keep(v)
+	if changed.zones == v.zones {
+		t.Error("zone states kept with different trust anchors")
+	}
+}
+
+func TestTrustAnchors(t *testing.T) {
+	for anchor, valid := range map[string]bool{
+		"test. IN DS 12345 13 2 3F1E":    true,
+		"test. IN DS 12345 15 2 3F1E":    false, // Ed25519
+		"test. IN DS 12345 13 3 3F1E":    false, // GOST
+		"test. IN A 192.0.2.1":           false,
+		"test. IN DNSKEY 257 3 15 AAAA=": false,
+	} {
+		readTestConfig(t, `
+dnssec: true
+trust_anchors: ["`+anchor+`"]
+`)
+		if _, err := newValidator(); (err == nil) != valid {
+			t.Errorf("%s: got error %v", anchor, err)
+		}
+	}
+}
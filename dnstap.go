@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// dnstap message types
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstap socket families and protocols
+const (
+	dnstapINET  = 1
+	dnstapINET6 = 2
+	dnstapUDP   = 1
+	dnstapTCP   = 2
+	dnstapDOT   = 3
+	dnstapDOH   = 4
+)
+
+// Frame Streams control frames
+const (
+	fstrmAccept      = 1
+	fstrmStart       = 2
+	fstrmStop        = 3
+	fstrmReady       = 4
+	fstrmFinish      = 5
+	fstrmContentType = 1
+
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+)
+
+// dnstapRetry is how long to wait before connecting again to a collector.
+const dnstapRetry = 5 * time.Second
+
+// dnstapOutput sends dnstap messages (`dnstap`) to a unix socket, a TCP
+// endpoint or a file. Messages wait in a bounded queue written by a
+// goroutine; when the queue is full they are dropped, so a slow collector
+// never delays queries.
+type dnstapOutput struct {
+	target    string
+	identity  string
+	queueSize int
+
+	queue   chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newDnstapOutput() (*dnstapOutput, error) {
+	d := &dnstapOutput{
+		target:    viper.GetString("dnstap"),
+		identity:  viper.GetString("dnstap_identity"),
+		queueSize: viper.GetInt("dnstap_queue_size"),
+	}
+	if d.target == "" {
+		return d, nil
+	}
+	if d.queueSize < 1 {
+		return nil, fmt.Errorf("dnstap_queue_size: must be at least 1, got %d", d.queueSize)
+	}
+	if strings.HasPrefix(d.target, "tcp:") {
+		if _, _, err := net.SplitHostPort(strings.TrimPrefix(d.target, "tcp:")); err != nil {
+			return nil, fmt.Errorf("dnstap: %v", err)
+		}
+	}
+	if d.identity == "" {
+		d.identity, _ = os.Hostname()
+	}
+	return d, nil
+}
+
+func (d *dnstapOutput) enabled() bool {
+	return d != nil && d.target != ""
+}
+
+// keep makes d use the running output of old when its settings didn't
+// change, so a reload doesn't reconnect.
+func (d *dnstapOutput) keep(old *dnstapOutput) {
+	if old.target == d.target && old.identity == d.identity && old.queueSize == d.queueSize {
+		d.queue, d.done, d.stopped = old.queue, old.done, old.stopped
+	}
+}
+
+func (d *dnstapOutput) start() {
+	if !d.enabled() || d.queue != nil {
+		return
+	}
+	d.queue = make(chan []byte, d.queueSize)
+	d.done = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go d.run(d.queue, d.done, d.stopped)
+}
+
+// stop flushes the queue and closes the output unless cur uses it.
+func (d *dnstapOutput) stop(cur *dnstapOutput) {
+	if d.queue == nil || d.queue == cur.queue {
+		return
+	}
+	d.once.Do(func() { close(d.done) })
+	<-d.stopped
+}
+
+func (d *dnstapOutput) run(queue chan []byte, done, stopped chan struct{}) {
+	defer close(stopped)
+	var (
+		w         *fstrmWriter
+		lastRetry time.Time
+	)
+	write := func(frame []byte) {
+		if w == nil && time.Since(lastRetry) > dnstapRetry {
+			var err error
+			if w, err = dialFstrm(d.target); err != nil {
+				serverLog.error("dnstap: error connecting", "target", d.target, "error", err)
+				lastRetry = time.Now()
+			}
+		}
+		if w == nil {
+			dnstapDropped.inc()
+			return
+		}
+		if err := w.writeFrame(frame, len(queue) == 0); err != nil {
+			serverLog.error("dnstap: error writing", "target", d.target, "error", err)
+			dnstapDropped.inc()
+			w.conn.Close()
+			if !w.bidirectional {
+				// the file may end with part of a frame: it is moved
+				// aside and a new one gets its own stream
+				path := strings.TrimPrefix(d.target, "file:")
+				if err := os.Rename(path, path+".1"); err != nil {
+					serverLog.error("dnstap: error rotating", "target", d.target, "error", err)
+				}
+			}
+			w, lastRetry = nil, time.Now()
+			return
+		}
+		dnstapSent.inc()
+	}
+	for {
+		select {
+		case frame := <-queue:
+			write(frame)
+		case <-done:
+			for len(queue) > 0 {
+				write(<-queue)
+			}
+			if w != nil {
+				w.close()
+			}
+			return
+		}
+	}
+}
+
+// send queues a dnstap message, dropping it if the queue is full.
+func (d *dnstapOutput) send(msg []byte) {
+	frame := appendBytesField(nil, 1, []byte(d.identity))
+	frame = appendBytesField(frame, 2, []byte("lresolver "+version))
+	frame = appendBytesField(frame, 14, msg)
+	frame = appendVarintField(frame, 15, 1) // MESSAGE
+	select {
+	case d.queue <- frame:
+	default:
+		dnstapDropped.inc()
+	}
+}
+
+// clientQuery sends the CLIENT_QUERY message of q.
+func (d *dnstapOutput) clientQuery(q *queryInfo) {
+	if !d.enabled() || d.queue == nil {
+		return
+	}
+	msg := dnstapMessage(dnstapClientQuery, q.transport, q.client, q.local)
+	msg = appendTime(msg, 8, q.start)
+	msg = appendMsgField(msg, 10, q.req)
+	d.send(msg)
+}
+
+// clientResponse sends the CLIENT_RESPONSE message of q, if answered.
+func (d *dnstapOutput) clientResponse(q *queryInfo) {
+	if !d.enabled() || d.queue == nil || q.resp == nil {
+		return
+	}
+	msg := dnstapMessage(dnstapClientResponse, q.transport, q.client, q.local)
+	msg = appendTime(msg, 8, q.start)
+	msg = appendMsgField(msg, 10, q.req)
+	msg = appendTime(msg, 12, time.Now())
+	msg = appendMsgField(msg, 14, q.resp)
+	d.send(msg)
+}
+
+// forwarderQuery sends the FORWARDER_QUERY message of req sent to
+// nameserver.
+func (d *dnstapOutput) forwarderQuery(req *dns.Msg, network, nameserver string, start time.Time) {
+	if !d.enabled() || d.queue == nil {
+		return
+	}
+	msg := dnstapMessage(dnstapForwarderQuery, network, nil, resolveAddr(network, nameserver))
+	msg = appendTime(msg, 8, start)
+	msg = appendMsgField(msg, 10, req)
+	d.send(msg)
+}
+
+// forwarderResponse sends the FORWARDER_RESPONSE message of in, the
+// response of nameserver to req.
+func (d *dnstapOutput) forwarderResponse(req, in *dns.Msg, network, nameserver string, start time.Time, rtt time.Duration) {
+	if !d.enabled() || d.queue == nil || in == nil {
+		return
+	}
+	msg := dnstapMessage(dnstapForwarderResponse, network, nil, resolveAddr(network, nameserver))
+	msg = appendTime(msg, 8, start)
+	msg = appendMsgField(msg, 10, req)
+	msg = appendTime(msg, 12, start.Add(rtt))
+	msg = appendMsgField(msg, 14, in)
+	d.send(msg)
+}
+
+func resolveAddr(network, addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	if network == "udp" {
+		return &net.UDPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// dnstapMessage starts a dnstap Message with its type, socket family and
+// protocol and addresses.
+func dnstapMessage(typ int, transport string, query, response net.Addr) []byte {
+	msg := appendVarintField(nil, 1, uint64(typ))
+	protocol := dnstapTCP
+	switch transport {
+	case "udp":
+		protocol = dnstapUDP
+	case "tcp-tls":
+		protocol = dnstapDOT
+	case "https", "http":
+		protocol = dnstapDOH
+	}
+	family := 0
+	for i, addr := range []net.Addr{query, response} {
+		ip := addrIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, family = ip4, dnstapINET
+		} else {
+			family = dnstapINET6
+		}
+		msg = appendBytesField(msg, 4+i, ip)
+		switch a := addr.(type) {
+		case *net.UDPAddr:
+			msg = appendVarintField(msg, 6+i, uint64(a.Port))
+		case *net.TCPAddr:
+			msg = appendVarintField(msg, 6+i, uint64(a.Port))
+		}
+	}
+	if family != 0 {
+		msg = appendVarintField(msg, 2, uint64(family))
+	}
+	return appendVarintField(msg, 3, uint64(protocol))
+}
+
+// appendTime appends a time as its seconds field and nanoseconds field.
+func appendTime(b []byte, field int, t time.Time) []byte {
+	b = appendVarintField(b, field, uint64(t.Unix()))
+	b = appendTag(b, field+1, 5) // fixed32
+	var nsec [4]byte
+	binary.LittleEndian.PutUint32(nsec[:], uint32(t.Nanosecond()))
+	return append(b, nsec[:]...)
+}
+
+func appendMsgField(b []byte, field int, m *dns.Msg) []byte {
+	wire, err := m.Pack()
+	if err != nil {
+		return b
+	}
+	return appendBytesField(b, field, wire)
+}
+
+// protocol buffers encoding
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return appendVarint(appendTag(b, field, 0), v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendTag(b, field, 2), uint64(len(v)))
+	return append(b, v...)
+}
+
+// fstrmWriter writes a Frame Streams stream. Sockets use the
+// bidirectional handshake, files are unidirectional.
+type fstrmWriter struct {
+	conn          io.ReadWriteCloser
+	w             *bufio.Writer
+	bidirectional bool
+}
+
+// dialFstrm opens the dnstap target: unix:<path>, tcp:<host:port> or a
+// file, which is truncated so it holds a single stream.
+func dialFstrm(target string) (*fstrmWriter, error) {
+	var (
+		conn          io.ReadWriteCloser
+		err           error
+		bidirectional = true
+	)
+	switch {
+	case strings.HasPrefix(target, "unix:"):
+		conn, err = net.DialTimeout("unix", strings.TrimPrefix(target, "unix:"), dnstapRetry)
+	case strings.HasPrefix(target, "tcp:"):
+		conn, err = net.DialTimeout("tcp", strings.TrimPrefix(target, "tcp:"), dnstapRetry)
+	default:
+		conn, err = os.Create(strings.TrimPrefix(target, "file:"))
+		bidirectional = false
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &fstrmWriter{conn: conn, w: bufio.NewWriter(conn), bidirectional: bidirectional}
+	if bidirectional {
+		if err := f.handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("handshake with %s: %v", target, err)
+		}
+	}
+	if err := f.writeControl(fstrmStart, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fstrmWriter) handshake() error {
+	if conn, ok := f.conn.(net.Conn); ok {
+		conn.SetDeadline(time.Now().Add(dnstapRetry))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := f.writeControl(fstrmReady, true); err != nil {
+		return err
+	}
+	typ, err := readControl(f.conn)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmAccept {
+		return fmt.Errorf("unexpected control frame %d", typ)
+	}
+	return nil
+}
+
+// writeControl writes a control frame, with the dnstap content type for
+// READY and START.
+func (f *fstrmWriter) writeControl(typ uint32, flush bool) error {
+	frame := make([]byte, 4)
+	binary.BigEndian.PutUint32(frame, typ)
+	if typ == fstrmReady || typ == fstrmStart {
+		var field [8]byte
+		binary.BigEndian.PutUint32(field[:4], fstrmContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(dnstapContentType)))
+		frame = append(append(frame, field[:]...), dnstapContentType...)
+	}
+	var header [8]byte // escape and length
+	binary.BigEndian.PutUint32(header[4:], uint32(len(frame)))
+	f.w.Write(header[:])
+	f.w.Write(frame)
+	if flush {
+		return f.w.Flush()
+	}
+	return nil
+}
+
+// readControl reads a control frame and returns its type.
+func readControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, fmt.Errorf("expected a control frame")
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 4 || n > 512 {
+		return 0, fmt.Errorf("invalid control frame length %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(frame[:4]), nil
+}
+
+func (f *fstrmWriter) writeFrame(frame []byte, flush bool) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	f.w.Write(length[:])
+	f.w.Write(frame)
+	if flush {
+		return f.w.Flush()
+	}
+	return nil
+}
+
+// close ends the stream, waiting for the collector to acknowledge it.
+func (f *fstrmWriter) close() {
+	if err := f.writeControl(fstrmStop, true); err == nil && f.bidirectional {
+		if conn, ok := f.conn.(net.Conn); ok {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+		}
+		readControl(f.conn) // FINISH
+	}
+	f.conn.Close()
+}
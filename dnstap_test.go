@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// protoFields decodes a protocol buffers message into its varint and bytes
+// fields.
+func protoFields(t *testing.T, b []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		case 5:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// readFrame reads a data frame, or returns the type of a control frame.
+func readFrame(r io.Reader) ([]byte, uint32, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, 0, err
+	}
+	if n := binary.BigEndian.Uint32(length[:]); n > 0 {
+		frame := make([]byte, n)
+		_, err := io.ReadFull(r, frame)
+		return frame, 0, err
+	}
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, 0, err
+	}
+	control := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, control); err != nil {
+		return nil, 0, err
+	}
+	return nil, binary.BigEndian.Uint32(control[:4]), nil
+}
+
+func writeControlFrame(w io.Writer, typ uint32) {
+	frame := make([]byte, 12)
+	binary.BigEndian.PutUint32(frame[4:], 4)
+	binary.BigEndian.PutUint32(frame[8:], typ)
+	w.Write(frame)
+}
+
+func TestDnstap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "dnstap.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// collector doing the bidirectional handshake
+	types := make(chan uint64, 10)
+	go func() {
+		defer close(types)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, typ, err := readFrame(conn); err != nil || typ != fstrmReady {
+			t.Errorf("expected READY, got %d %v", typ, err)
+			return
+		}
+		writeControlFrame(conn, fstrmAccept)
+		for {
+			frame, typ, err := readFrame(conn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch {
+			case frame != nil:
+				tap := protoFields(t, frame)
+				msg := protoFields(t, tap[14][0].([]byte))
+				types <- msg[1][0].(uint64)
+			case typ == fstrmStop:
+				writeControlFrame(conn, fstrmFinish)
+				return
+			}
+		}
+	}()
+
+	// upstream nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{mustRR(t, req.Question[0].Name+" 60 IN A 192.0.2.10")}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	readTestConfig(t, `
+nameservers: ["`+pc.LocalAddr().String()+`"]
+cache: false
+dnstap: unix:`+sock+`
+dnstap_identity: test
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.dnstap.start()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	cfg.resolve(nil, w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("unexpected response %v", w.msg)
+	}
+	cfg.dnstap.stop(&dnstapOutput{})
+
+	var got []uint64
+	for typ := range types {
+		got = append(got, typ)
+	}
+	want := []uint64{dnstapClientQuery, dnstapForwarderQuery, dnstapForwarderResponse, dnstapClientResponse}
+	if len(got) != len(want) {
+		t.Fatalf("got messages %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got messages %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestDnstapMessage(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	msg := protoFields(t, dnstapMessage(dnstapClientQuery, "udp", client, local))
+	if msg[1][0] != uint64(dnstapClientQuery) || msg[2][0] != uint64(dnstapINET) || msg[3][0] != uint64(dnstapUDP) {
+		t.Errorf("unexpected type, family or protocol: %v", msg)
+	}
+	if ip := net.IP(msg[4][0].([]byte)); !ip.Equal(client.IP) || len(ip) != 4 {
+		t.Errorf("query address %v", ip)
+	}
+	if msg[6][0] != uint64(5353) || msg[7][0] != uint64(53) {
+		t.Errorf("ports %v %v", msg[6], msg[7])
+	}
+	msg = protoFields(t, dnstapMessage(dnstapClientQuery, "tcp-tls", &net.TCPAddr{IP: net.ParseIP("::1")}, nil))
+	if msg[2][0] != uint64(dnstapINET6) || msg[3][0] != uint64(dnstapDOT) {
+		t.Errorf("unexpected family or protocol: %v", msg)
+	}
+}
+
+func TestDnstapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.dnstap")
+	// a second run replaces the stream of the first one
+	for i := 0; i < 2; i++ {
+		d := &dnstapOutput{target: path, identity: "test", queueSize: 10}
+		d.start()
+		q := &queryInfo{req: new(dns.Msg).SetQuestion("example.com.", dns.TypeA), transport: "udp"}
+		d.clientQuery(q)
+		d.stop(&dnstapOutput{})
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var frames []string
+	for {
+		frame, typ, err := readFrame(f)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame != nil {
+			frames = append(frames, "data")
+		} else {
+			frames = append(frames, map[uint32]string{fstrmStart: "start", fstrmStop: "stop"}[typ])
+		}
+	}
+	if got := strings.Join(frames, " "); got != "start data stop" {
+		t.Errorf("unexpected frames %s", got)
+	}
+}
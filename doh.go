@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	httpsPort = "443"
+	httpPort  = "80"
+
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+	dohJSONType    = "application/dns-json"
+	dohMaxSize     = dns.MaxMsgSize
+)
+
+// httpServer serves HTTP on a listener: DNS-over-HTTPS (RFC 8484) queries,
+// over plain HTTP when lresolver runs behind a proxy terminating TLS, or
+// the admin endpoints.
+type httpServer struct {
+	ln  net.Listener
+	srv *http.Server
+}
+
+func newHTTPServer(ln net.Listener, handler http.Handler) *httpServer {
+	return &httpServer{
+		ln: ln,
+		srv: &http.Server{
+			Handler:      handler,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  2 * time.Minute,
+		},
+	}
+}
+
+func newDoHServer(addr string, ln net.Listener) *httpServer {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, serveDoH(addr))
+	return newHTTPServer(ln, mux)
+}
+
+func (s *httpServer) serve(ready func()) error {
+	ready()
+	if err := s.srv.Serve(s.ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *httpServer) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *httpServer) close() {
+	s.ln.Close()
+}
+
+// dohResponseWriter is the dns.ResponseWriter given to the resolve pipeline
+// for DoH queries. It keeps the response to be written as the HTTP body.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohResponseWriter) Close() error         { return nil }
+func (w *dohResponseWriter) TsigStatus() error    { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)  {}
+func (w *dohResponseWriter) Hijack()              {}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+// serveDoH returns the HTTP handler of the DoH listener on addr. Queries
+// go through the same handler as the other transports of the listener.
+func serveDoH(addr string) http.Handler {
+	handler := serveListener(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := getConfig().listener(addr)
+		jsonAPI := l != nil && l.JSON && r.Method == http.MethodGet && r.URL.Query().Get("name") != ""
+
+		var (
+			req    *dns.Msg
+			status int
+			err    error
+		)
+		if jsonAPI {
+			req, err = dohJSONRequest(r)
+			status = http.StatusBadRequest
+		} else {
+			req, status, err = dohRequest(r)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		rw := &dohResponseWriter{remote: httpRemoteAddr(r)}
+		rw.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		handler.ServeDNS(rw, req)
+		if rw.msg == nil {
+			// dropped by a policy
+			http.Error(w, "no response", http.StatusBadGateway)
+			return
+		}
+
+		var body []byte
+		if jsonAPI {
+			body, err = json.Marshal(newDoHJSON(rw.msg))
+			w.Header().Set("Content-Type", dohJSONType)
+		} else {
+			body, err = rw.msg.Pack()
+			w.Header().Set("Content-Type", dohContentType)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL(rw.msg)), 10))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	})
+}
+
+// dohRequest reads the DNS message of a GET (dns parameter) or POST (body)
+// request, returning the HTTP status to use on error.
+func dohRequest(r *http.Request) (*dns.Msg, int, error) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing dns parameter")
+		}
+		var err error
+		// base64url without padding, tolerating padding anyway
+		if buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid dns parameter: %v", err)
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohContentType {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", ct)
+		}
+		var err error
+		if buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dohMaxSize+1)); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(buf) > dohMaxSize {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("message too large")
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid DNS message: %v", err)
+	}
+	return req, http.StatusOK, nil
+}
+
+// httpRemoteAddr returns the client address of r as a TCP address, like
+// the one of a DNS query over TCP.
+func httpRemoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// minTTL returns how long a response can be cached: the lowest TTL of its
+// answer and authority records, using the SOA minimum for negative answers
+// (RFC 2308).
+func minTTL(m *dns.Msg) uint32 {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	return ttl
+}
+
+// dohJSON is a response in the JSON format used by public DoH resolvers.
+type dohJSON struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJSONQuestion `json:"Question"`
+	Answer    []dohJSONRR       `json:"Answer,omitempty"`
+	Authority []dohJSONRR       `json:"Authority,omitempty"`
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// dohJSONRequest builds the query for a JSON API request, e.g.
+// /dns-query?name=example.com&type=AAAA.
+func dohJSONRequest(r *http.Request) (*dns.Msg, error) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	qtype := dns.TypeA
+	if t := query.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			return nil, fmt.Errorf("invalid type %q", t)
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = query.Get("cd") == "1" || query.Get("cd") == "true"
+	return req, nil
+}
+
+func newDoHJSON(m *dns.Msg) *dohJSON {
+	resp := &dohJSON{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	convert := func(rrs []dns.RR) []dohJSONRR {
+		var list []dohJSONRR
+		for _, rr := range rrs {
+			h := rr.Header()
+			list = append(list, dohJSONRR{
+				Name: h.Name,
+				Type: h.Rrtype,
+				TTL:  h.Ttl,
+				Data: strings.TrimPrefix(rr.String(), h.String()),
+			})
+		}
+		return list
+	}
+	resp.Answer = convert(m.Answer)
+	resp.Authority = convert(m.Ns)
+	return resp
+}
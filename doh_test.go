@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHHandler(t *testing.T) {
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+records:
+- db.corp. 60 IN A 10.1.2.3
+- db.corp. 30 IN A 10.1.2.4
+listeners:
+- address: '127.0.0.1:8053'
+  transports: [http]
+  json: true
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Store(cfg)
+	handler := serveDoH("127.0.0.1:8053")
+
+	m := new(dns.Msg)
+	m.SetQuestion("db.corp.", dns.TypeA)
+	m.Id = 0
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest("GET", dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+	post := httptest.NewRequest("POST", dohPath, bytes.NewReader(wire))
+	post.Header.Set("Content-Type", dohContentType)
+	for _, req := range []*http.Request{get, post} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", req.Method, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != dohContentType {
+			t.Errorf("%s: content type %q", req.Method, ct)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "max-age=30" {
+			t.Errorf("%s: cache control %q, want max-age=30", req.Method, cc)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(rec.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 2 {
+			t.Errorf("%s: unexpected answer %v", req.Method, r.Answer)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", dohPath+"?name=db.corp&type=A", nil))
+	var resp dohJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rec.Body, err)
+	}
+	if resp.Status != dns.RcodeSuccess || len(resp.Answer) != 2 || !strings.HasPrefix(resp.Answer[0].Data, "10.1.2.") {
+		t.Errorf("unexpected JSON response %s", rec.Body)
+	}
+
+	bad := map[*http.Request]int{
+		httptest.NewRequest("GET", dohPath, nil):                    http.StatusBadRequest,
+		httptest.NewRequest("GET", dohPath+"?dns=!!", nil):          http.StatusBadRequest,
+		httptest.NewRequest("GET", dohPath+"?dns=AAAA", nil):        http.StatusBadRequest,
+		httptest.NewRequest("POST", dohPath, bytes.NewReader(wire)): http.StatusUnsupportedMediaType,
+		httptest.NewRequest("PUT", dohPath, nil):                    http.StatusMethodNotAllowed,
+	}
+	for req, status := range bad {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s %s: status %d, want %d", req.Method, req.URL, rec.Code, status)
+		}
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	m := new(dns.Msg)
+	if ttl := minTTL(m); ttl != 0 {
+		t.Errorf("empty response ttl = %d", ttl)
+	}
+	m.Ns = []dns.RR{mustRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300")}
+	if ttl := minTTL(m); ttl != 300 {
+		t.Errorf("negative response ttl = %d, want 300", ttl)
+	}
+}
+
+func TestDoHListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-doh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server", 1, nil, nil)
+
+	addr := freeTCPAddr(t)
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+records:
+- db.corp. 60 IN A 10.1.2.3
+listeners:
+- address: "`+addr+`"
+  transports: [https]
+  cert: `+filepath.Join(dir, "server.crt")+`
+  key: `+filepath.Join(dir, "server.key")+`
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServers()
+	defer stopCertWatch(cfg.listeners)
+
+	m := new(dns.Msg)
+	m.SetQuestion("db.corp.", dns.TypeA)
+	wire, _ := m.Pack()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Post("https://"+addr+dohPath, dohContentType, bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil || len(r.Answer) != 1 {
+		t.Errorf("unexpected response %v: %v", r, err)
+	}
+}
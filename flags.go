@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const envPrefix = "LRESOLVER"
+
+// configFlag is a command line flag overriding a configuration directive.
+// It implements both flag.Value and viper.FlagValue so viper only uses it
+// when it was set on the command line.
+type configFlag struct {
+	key   string
+	kind  string
+	value string
+	set   bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *configFlag) Set(value string) error {
+	f.value = value
+	f.set = true
+	return nil
+}
+
+// IsBoolFlag allows boolean directives to be set with just -name.
+func (f *configFlag) IsBoolFlag() bool { return f.kind == kindBool }
+
+func (f *configFlag) HasChanged() bool    { return f.set }
+func (f *configFlag) Name() string        { return f.key }
+func (f *configFlag) ValueString() string { return f.value }
+
+func (f *configFlag) ValueType() string {
+	switch f.kind {
+	case kindBool:
+		return "bool"
+	case kindInt:
+		return "int"
+	}
+	return "string"
+}
+
+// flagDirectives returns the directives that can be set from the command
+// line and the environment: all of them except lists of maps.
+func flagDirectives() []string {
+	var keys []string
+	for key, schema := range configSchema {
+		if schema.kind != kindList {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// registerConfigFlags adds a flag named after each directive. It must be
+// called before flag.Parse.
+func registerConfigFlags() {
+	for _, key := range flagDirectives() {
+		kind := configSchema[key].kind
+		usage := "Overrides the " + key + " directive"
+		if kind == kindStrings {
+			usage += " (comma separated list)"
+		}
+		flag.Var(&configFlag{key: key, kind: kind}, key, usage)
+	}
+}
+
+// bindConfigFlags binds the directive flags and LRESOLVER_* environment
+// variables to viper. Precedence is flag > env > file > default.
+func bindConfigFlags() {
+	viper.SetEnvPrefix(envPrefix)
+	for _, key := range flagDirectives() {
+		viper.BindEnv(key)
+		if f := flag.Lookup(key); f != nil {
+			viper.BindFlagValue(key, f.Value.(*configFlag))
+		}
+	}
+}
+
+// envName returns the environment variable for a directive.
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(key)
+}
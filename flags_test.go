@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	readTestConfig(t, "max_cache_ttl: 10\nnameservers: [8.8.8.8]\n")
+	bindConfigFlags()
+	if got := viper.GetInt64("max_cache_ttl"); got != 10 {
+		t.Errorf("file value = %d, want 10", got)
+	}
+
+	os.Setenv(envName("max_cache_ttl"), "20")
+	os.Setenv(envName("nameservers"), "1.1.1.1, 9.9.9.9")
+	defer os.Unsetenv(envName("max_cache_ttl"))
+	defer os.Unsetenv(envName("nameservers"))
+	if got := viper.GetInt64("max_cache_ttl"); got != 20 {
+		t.Errorf("env value = %d, want 20", got)
+	}
+	if got := configStrings("nameservers"); len(got) != 2 || got[1] != "9.9.9.9" {
+		t.Errorf("env list = %v", got)
+	}
+
+	f := flag.Lookup("max_cache_ttl").Value.(*configFlag)
+	f.Set("30")
+	defer func() { f.value, f.set = "", false }()
+	if got := viper.GetInt64("max_cache_ttl"); got != 30 {
+		t.Errorf("flag value = %d, want 30", got)
+	}
+}
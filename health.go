@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// how long -healthcheck waits for the answer
+const healthcheckTimeout = 5 * time.Second
+
+// serversHealth returns an error if no listener is running or if a server
+// stopped serving.
+func serversHealth() error {
+	smu.Lock()
+	defer smu.Unlock()
+	if len(dnsServers) == 0 {
+		return errors.New("no listener running")
+	}
+	for key, err := range failedServers {
+		if err == nil {
+			err = errors.New("stopped")
+		}
+		return fmt.Errorf("server %s: %v", key, err)
+	}
+	return nil
+}
+
+// ready returns an error if every nameserver is down or if
+// `health_canary` doesn't resolve. Nameservers not queried yet aren't down.
+func (cfg *runtimeConfig) ready() error {
+	if !cfg.servers.anyUp() {
+		return errors.New("no nameserver up")
+	}
+	if canary := cfg.canary; canary != "" {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(canary), dns.TypeA)
+		in, err := cfg.servers.probe(req)
+		if err != nil {
+			return fmt.Errorf("canary %s: %v", canary, err)
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("canary %s: %s", canary, rcodeString(in.Rcode))
+		}
+	}
+	return nil
+}
+
+// anyUp reports whether a nameserver is up, or unknown before its first
+// query.
+func (servers *nameservers) anyUp() bool {
+	upstreamMu.Lock()
+	defer upstreamMu.Unlock()
+	for _, server := range servers.slist {
+		if upstreamStats[server].health() != "down" {
+			return true
+		}
+	}
+	return false
+}
+
+// probe sends req to the nameservers in order until one answers it with
+// NOERROR. Unlike forward, it isn't counted in the metrics and status of
+// the nameservers.
+func (servers *nameservers) probe(req *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: servers.timeout}
+	var in *dns.Msg
+	err := errors.New("no nameservers")
+	for _, nameserver := range servers.slist {
+		if in, _, err = client.Exchange(req, nameserver); err == nil && in.Rcode == dns.RcodeSuccess {
+			break
+		}
+	}
+	return in, err
+}
+
+// serveHealthz is the handler of /healthz.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, serversHealth())
+}
+
+// serveReadyz is the handler of /readyz.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	err := serversHealth()
+	if err == nil {
+		err = getConfig().ready()
+	}
+	writeHealth(w, err)
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthcheck sends `health_canary` to the first DNS listener, for
+// -healthcheck, and returns the exit status: 0 if it answered, with any
+// response code but SERVFAIL, and 1 otherwise.
+func healthcheck() int {
+	listeners, err := parseListeners()
+	if err != nil {
+		fmt.Println("unhealthy:", err)
+		return 1
+	}
+	for _, l := range listeners {
+		for _, transport := range l.Transports {
+			if transport != "udp" && transport != "tcp" {
+				continue
+			}
+			err := queryListener(transport, localAddress(l.Address), viper.GetString("health_canary"))
+			if err != nil {
+				fmt.Println("unhealthy:", err)
+				return 1
+			}
+			fmt.Println("healthy")
+			return 0
+		}
+	}
+	fmt.Println("unhealthy: no udp or tcp listener")
+	return 1
+}
+
+func queryListener(network, addr, name string) error {
+	if name == "" {
+		name = "."
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	client := &dns.Client{Net: network, Timeout: healthcheckTimeout}
+	in, _, err := client.Exchange(req, addr)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", network, addr, err)
+	}
+	if in.Rcode == dns.RcodeServerFailure {
+		return fmt.Errorf("%s %s: %s", network, addr, rcodeString(in.Rcode))
+	}
+	return nil
+}
+
+// localAddress returns the address to reach a listener bound to addr from
+// the same host.
+func localAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealth(t *testing.T) {
+	// upstream nameserver over udp and tcp, failing for fail.example.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name == "fail.example." {
+			m.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(m)
+	})
+	for _, upstream := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: ln, Handler: handler}} {
+		go upstream.ActivateAndServe()
+		defer upstream.Shutdown()
+	}
+
+	get := func(handler func(*httptest.ResponseRecorder)) (int, string) {
+		rec := httptest.NewRecorder()
+		handler(rec)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	healthz := func(rec *httptest.ResponseRecorder) { serveHealthz(rec, httptest.NewRequest("GET", "/healthz", nil)) }
+	readyz := func(rec *httptest.ResponseRecorder) { serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil)) }
+
+	stopServers()
+	if code, body := get(healthz); code != 503 || body != "no listener running" {
+		t.Errorf("healthz = %d %q with no listener", code, body)
+	}
+
+	addr := freeTCPAddr(t)
+	config := `
+nameservers: ["` + pc.LocalAddr().String() + `"]
+cache: false
+listeners: [{address: "` + addr + `", transports: [tcp]}]
+health_canary: `
+	readTestConfig(t, config+"ok.example")
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServers()
+	if code, body := get(healthz); code != 200 || body != "ok" {
+		t.Errorf("healthz = %d %q", code, body)
+	}
+	if code, body := get(readyz); code != 200 || body != "ok" {
+		t.Errorf("readyz = %d %q", code, body)
+	}
+	if status := healthcheck(); status != 0 {
+		t.Errorf("healthcheck exit status %d, want 0", status)
+	}
+
+	readTestConfig(t, config+"fail.example")
+	if cfg, err = buildConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	queries := upstreamQueries.get(pc.LocalAddr().String())
+	if code, body := get(readyz); code != 503 || body != "canary fail.example: SERVFAIL" {
+		t.Errorf("readyz = %d %q with a failing canary", code, body)
+	}
+	// the canary isn't counted as a query to the nameserver
+	if n := upstreamQueries.get(pc.LocalAddr().String()); n != queries {
+		t.Errorf("canary counted in the upstream metrics: %v queries, want %v", n, queries)
+	}
+	if status := healthcheck(); status != 1 {
+		t.Errorf("healthcheck exit status %d with a failing canary, want 1", status)
+	}
+
+	// the canary resolves, but the nameservers failed the last queries
+	readTestConfig(t, config+"ok.example")
+	if cfg, err = buildConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < upstreamDownAfter; i++ {
+		recordUpstream(pc.LocalAddr().String(), 0, errors.New("timeout"), true)
+	}
+	if code, body := get(readyz); code != 503 || body != "no nameserver up" {
+		t.Errorf("readyz = %d %q with every nameserver down", code, body)
+	}
+	pruneUpstreamStats(nil)
+
+	stopServers()
+	if status := healthcheck(); status != 1 {
+		t.Errorf("healthcheck exit status %d with the server stopped, want 1", status)
+	}
+}
+
+func TestLocalAddress(t *testing.T) {
+	tests := map[string]string{
+		"0.0.0.0:53":   "127.0.0.1:53",
+		":53":          "127.0.0.1:53",
+		"[::]:53":      "[::1]:53",
+		"10.0.0.1:53":  "10.0.0.1:53",
+		"[fd00::1]:53": "[fd00::1]:53",
+	}
+	for addr, want := range tests {
+		if got := localAddress(addr); got != want {
+			t.Errorf("localAddress(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
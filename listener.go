@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+const defaultBind = "127.0.0.1"
+
+// listener is an address lresolver answers queries on, with the transports
+// it listens to and the clients allowed or denied to query it. DNS-over-TLS and
+// DNS-over-HTTPS listeners (transports tcp-tls and https) also have a
+// certificate.
+type listener struct {
+	Address    string   `mapstructure:"address"`
+	Transports []string `mapstructure:"transports"`
+	Allow      []string `mapstructure:"allow"`
+	Deny       []string `mapstructure:"deny"`
+	ACLAction  string   `mapstructure:"acl_action"`
+	Cert       string   `mapstructure:"cert"`
+	Key        string   `mapstructure:"key"`
+	ClientCA   string   `mapstructure:"client_ca"`
+	JSON       bool     `mapstructure:"json"` // DoH JSON API
+
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	aclDrop bool
+	certs   *certStore
+}
+
+// parseListeners builds the listeners from the `bind` addresses, which use
+// the global `tcp` setting and accept any client, the `tls_bind` addresses,
+// which use the global `tls_*` settings, and the `listeners` entries. With
+// none configured lresolver listens on 127.0.0.1. The admin HTTP server on
+// `admin_bind`, if set, is added as a listener with the internal admin
+// transport.
+func parseListeners() ([]*listener, error) {
+	var list []*listener
+	if err := viper.UnmarshalKey("listeners", &list); err != nil {
+		return nil, err
+	}
+	binds := configStrings("bind")
+	if len(binds) == 0 && len(list) == 0 {
+		binds = []string{defaultBind}
+	}
+	var fromBind []*listener
+	for _, addr := range binds {
+		fromBind = append(fromBind, &listener{Address: addr, Transports: getTransports(viper.GetBool("tcp"))})
+	}
+	for _, addr := range configStrings("tls_bind") {
+		fromBind = append(fromBind, &listener{
+			Address:    addr,
+			Transports: []string{"tcp-tls"},
+			Cert:       viper.GetString("tls_cert"),
+			Key:        viper.GetString("tls_key"),
+			ClientCA:   viper.GetString("tls_client_ca"),
+		})
+	}
+	list = append(fromBind, list...)
+
+	seen := make(map[string]bool)
+	for _, l := range list {
+		if len(l.Transports) == 0 {
+			l.Transports = []string{"udp"}
+		}
+		// transports with their own port can't share the address
+		defaultPort := "53"
+		for i, transport := range l.Transports {
+			transport = strings.ToLower(transport)
+			switch transport {
+			case "udp", "tcp":
+			case "tcp-tls":
+				defaultPort = tlsPort
+			case "https":
+				defaultPort = httpsPort
+			case "http":
+				defaultPort = httpPort
+			default:
+				return nil, fmt.Errorf("listener %s: unsupported transport %q", l.Address, transport)
+			}
+			l.Transports[i] = transport
+		}
+		if defaultPort != "53" && len(l.Transports) > 1 {
+			return nil, fmt.Errorf("listener %s: %v can't share an address", l.Address, l.Transports)
+		}
+		tls := l.Transports[0] == "tcp-tls" || l.Transports[0] == "https"
+
+		addr, err := fixAddress(l.Address, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %v", l.Address, err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("listener %q: address used more than once", l.Address)
+		}
+		seen[addr] = true
+		l.Address = addr
+
+		if tls {
+			if l.certs, err = newCertStore(l.Cert, l.Key, l.ClientCA); err != nil {
+				return nil, fmt.Errorf("listener %s: %v", addr, err)
+			}
+		} else if l.Cert != "" || l.Key != "" || l.ClientCA != "" {
+			return nil, fmt.Errorf("listener %s: cert, key and client_ca are only used by tcp-tls and https", addr)
+		}
+		if l.JSON && l.Transports[0] != "https" && l.Transports[0] != "http" {
+			return nil, fmt.Errorf("listener %s: json is only used by https and http", addr)
+		}
+
+		for _, cidr := range l.Allow {
+			ipnet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %v", addr, err)
+			}
+			l.allow = append(l.allow, ipnet)
+		}
+		for _, cidr := range l.Deny {
+			ipnet, err := parseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %v", addr, err)
+			}
+			l.deny = append(l.deny, ipnet)
+		}
+		if l.aclDrop, err = parseACLAction(l.ACLAction); err != nil {
+			return nil, fmt.Errorf("listener %s: acl_action: %v", addr, err)
+		}
+	}
+
+	if admin := viper.GetString("admin_bind"); admin != "" {
+		addr, err := fixAddress(admin, adminPort)
+		if err != nil {
+			return nil, fmt.Errorf("admin_bind: %v", err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("admin_bind: address %s already used by a listener", addr)
+		}
+		list = append(list, &listener{Address: addr, Transports: []string{"admin"}})
+	}
+	return list, nil
+}
+
+// parseCIDR parses a network, taking a plain IP address as a single host.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", cidr)
+	}
+	return ipnet, nil
+}
+
+// allowed reports whether a client may query the listener: it must not be
+// in the deny list and, if there is an allow list, it must be in it.
+func (l *listener) allowed(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if containsIP(l.deny, ip) {
+		return false
+	}
+	return len(l.allow) == 0 || containsIP(l.allow, ip)
+}
+
+// listener returns the listener configured on addr, if any.
+func (cfg *runtimeConfig) listener(addr string) *listener {
+	for _, l := range cfg.listeners {
+		if l.Address == addr {
+			return l
+		}
+	}
+	return nil
+}
+
+// serveListener returns the handler for the servers of the listener on
+// addr. Listener settings are taken from the current configuration on
+// every query, so changes apply without restarting the servers.
+func serveListener(addr string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		cfg := getConfig()
+		cfg.resolve(cfg.listener(addr), w, req)
+	})
+}
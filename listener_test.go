@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	readTestConfig(t, `
+bind: ["127.0.0.1:5300", "::1"]
+tcp: false
+listeners:
+- address: 10.0.0.1
+  transports: [udp, TCP]
+  allow: [10.0.0.0/8, 192.168.1.1]
+`)
+	list, err := parseListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expected 3 listeners, got %d", len(list))
+	}
+	want := []struct {
+		addr       string
+		transports int
+	}{
+		{"127.0.0.1:5300", 1},
+		{"[::1]:53", 1},
+		{"10.0.0.1:53", 2},
+	}
+	for i, w := range want {
+		if list[i].Address != w.addr || len(list[i].Transports) != w.transports {
+			t.Errorf("listener %d = %s %v, want %s", i, list[i].Address, list[i].Transports, w.addr)
+		}
+	}
+
+	acl := list[2]
+	for addr, allowed := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"::1":         false,
+	} {
+		if got := acl.allowed(&net.UDPAddr{IP: net.ParseIP(addr)}); got != allowed {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, allowed)
+		}
+	}
+	if !list[0].allowed(&net.TCPAddr{IP: net.ParseIP("8.8.8.8")}) {
+		t.Error("listener without allow list should accept every client")
+	}
+
+	invalid := []string{
+		"bind: [127.0.0.1, '127.0.0.1:53']\n",
+		"listeners: [{address: 127.0.0.1, transports: [quic]}]\n",
+		"listeners: [{address: 127.0.0.1, allow: [10.0.0.0/33]}]\n",
+	}
+	for _, yamlConfig := range invalid {
+		readTestConfig(t, yamlConfig)
+		if _, err := parseListeners(); err == nil {
+			t.Errorf("expected error for config %q", yamlConfig)
+		}
+	}
+
+	// with no listeners configured lresolver listens on 127.0.0.1
+	readTestConfig(t, "tcp: true\n")
+	if list, _ := parseListeners(); len(list) != 1 || list[0].Address != "127.0.0.1:53" || len(list[0].Transports) != 2 {
+		t.Errorf("unexpected default listeners %+v", list)
+	}
+}
+
+func TestStartServersFailsFast(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.LocalAddr().String()
+	free.Close()
+
+	listeners := []*listener{
+		{Address: freeAddr, Transports: []string{"udp"}},
+		{Address: l.LocalAddr().String(), Transports: []string{"udp"}},
+	}
+	if err := startServers(listeners); err == nil {
+		t.Fatal("expected error binding a used address")
+	}
+	// nothing was left listening
+	conn, err := net.ListenPacket("udp", freeAddr)
+	if err != nil {
+		t.Errorf("address %s still in use: %v", freeAddr, err)
+	} else {
+		conn.Close()
+	}
+	stopServers()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level logLevel) String() string {
+	return levelNames[level]
+}
+
+func parseLevel(name string) (logLevel, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, use one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// a log file from -log_dir is rotated like the query log
+const (
+	logMaxSize    = 100 * 1024 * 1024
+	logMaxBackups = 5
+)
+
+var (
+	logDir       string
+	logToStderr  bool
+	logVerbosity int
+)
+
+// ignoredLogFlags are the glog flags still accepted, so existing command
+// lines keep working, but ignored.
+var ignoredLogFlags = map[string]string{
+	"alsologtostderr":  "log_output",
+	"stderrthreshold":  "log_output",
+	"vmodule":          "log_levels",
+	"log_backtrace_at": "",
+}
+
+func init() {
+	// kept from glog for existing deployments
+	flag.StringVar(&logDir, "log_dir", "", "Write the log to lresolver.log in this directory, unless log_output is set")
+	flag.BoolVar(&logToStderr, "logtostderr", false, "Write the log to stderr, whatever log_output and -log_dir are")
+	flag.IntVar(&logVerbosity, "v", 0, "Log at debug level when 1 or more, unless log_levels sets the component level (deprecated, use log_level)")
+	flag.Bool("alsologtostderr", false, "Ignored (deprecated, use log_output)")
+	flag.String("stderrthreshold", "", "Ignored (deprecated, use log_output)")
+	flag.String("vmodule", "", "Ignored (deprecated, use log_levels)")
+	flag.String("log_backtrace_at", "", "Ignored (deprecated)")
+}
+
+// warnIgnoredLogFlags logs the ignored glog flags set on the command line.
+func warnIgnoredLogFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		directive, ok := ignoredLogFlags[f.Name]
+		switch {
+		case ok && directive != "":
+			configLog.warn("ignoring deprecated flag", "flag", "-"+f.Name, "use", directive)
+		case ok:
+			configLog.warn("ignoring deprecated flag", "flag", "-"+f.Name)
+		}
+	})
+}
+
+// logger logs the messages of a component at or above its level.
+type logger struct {
+	component string
+	level     int32 // logLevel, changed at runtime
+}
+
+var (
+	serverLog   = &logger{component: "server", level: int32(levelInfo)}
+	cacheLog    = &logger{component: "cache", level: int32(levelInfo)}
+	upstreamLog = &logger{component: "upstream", level: int32(levelInfo)}
+	configLog   = &logger{component: "config", level: int32(levelInfo)}
+
+	loggers = map[string]*logger{"server": serverLog, "cache": cacheLog, "upstream": upstreamLog, "config": configLog}
+)
+
+func (l *logger) getLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *logger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// The messages are followed by key and value pairs.
+func (l *logger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	if level < l.getLevel() {
+		return
+	}
+	logMu.RLock()
+	out := logOutput
+	logMu.RUnlock()
+	line := out.format(time.Now(), level, l.component, msg, kv)
+	var err error
+	if s, ok := out.sink.(*syslogSink); ok {
+		err = s.writeLevel(level, line)
+	} else {
+		err = out.sink.write(line)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error writing log:", err)
+		os.Stderr.Write(line)
+	}
+}
+
+// logConfig is where and how the log is written (`log_output`,
+// `log_format`) and the levels of the components (`log_level`,
+// `log_levels`).
+type logConfig struct {
+	target string
+	json   bool
+	level  logLevel
+	levels map[string]logLevel
+
+	sink lineSink
+}
+
+var (
+	logMu     sync.RWMutex
+	logOutput = &logConfig{target: "stderr", level: levelInfo, sink: &writerSink{f: os.Stderr}}
+)
+
+func newLogConfig() (*logConfig, error) {
+	lc := &logConfig{target: viper.GetString("log_output"), levels: make(map[string]logLevel)}
+	switch {
+	case logToStderr:
+		lc.target = "stderr"
+	case logDir != "":
+		lc.target = filepath.Join(logDir, "lresolver.log")
+	case lc.target == "":
+		lc.target = "stderr"
+	}
+	switch format := viper.GetString("log_format"); format {
+	case "text":
+	case "json":
+		lc.json = true
+	default:
+		return nil, fmt.Errorf("log_format: must be text or json, got %q", format)
+	}
+	var err error
+	if lc.level, err = parseLevel(viper.GetString("log_level")); err != nil {
+		return nil, fmt.Errorf("log_level: %v", err)
+	}
+	if logVerbosity > 0 {
+		lc.level = levelDebug
+	}
+	for _, entry := range configStrings("log_levels") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || loggers[parts[0]] == nil {
+			return nil, fmt.Errorf("log_levels: invalid %q, use component=level with a component of %s", entry, strings.Join(logComponents(), ", "))
+		}
+		if lc.levels[parts[0]], err = parseLevel(parts[1]); err != nil {
+			return nil, fmt.Errorf("log_levels: %v", err)
+		}
+	}
+	return lc, nil
+}
+
+// apply makes lc the log configuration, keeping the current sink if the
+// target didn't change or the new one can't be opened.
+func (lc *logConfig) apply() error {
+	for name, l := range loggers {
+		level, ok := lc.levels[name]
+		if !ok {
+			level = lc.level
+		}
+		l.setLevel(level)
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	old := logOutput
+	var err error
+	if lc.target == old.target {
+		lc.sink = old.sink
+	} else if lc.sink, err = openLogSink(lc.target); err != nil {
+		lc.target, lc.sink = old.target, old.sink
+		err = fmt.Errorf("log_output: %v", err)
+	}
+	logOutput = lc
+	if old.sink != lc.sink {
+		old.sink.close()
+	}
+	return err
+}
+
+func openLogSink(target string) (lineSink, error) {
+	if target == "stderr" {
+		return &writerSink{f: os.Stderr}, nil
+	}
+	return openSink(target, logMaxSize, logMaxBackups)
+}
+
+// format renders a log line as text, e.g.
+//
+//	2006-01-02T15:04:05.000Z info server: starting server server=udp/127.0.0.1:53
+//
+// or as a JSON object.
+func (lc *logConfig) format(t time.Time, level logLevel, component, msg string, kv []interface{}) []byte {
+	ts := t.UTC().Format("2006-01-02T15:04:05.000Z")
+	if lc.json {
+		var buf bytes.Buffer
+		buf.WriteString(`{"time":` + strconv.Quote(ts) + `,"level":"` + level.String() + `","component":"` + component + `","msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(kv); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(kv[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonLogValue(logValue(kv, i+1)))
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes()
+	}
+	var buf bytes.Buffer
+	buf.WriteString(ts + " " + level.String() + " " + component + ": " + msg)
+	for i := 0; i < len(kv); i += 2 {
+		buf.WriteString(" " + fmt.Sprint(kv[i]) + "=" + textLogValue(logValue(kv, i+1)))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// logValue returns the value of the pair with the key before i.
+func logValue(kv []interface{}, i int) interface{} {
+	if i >= len(kv) {
+		return "(missing)"
+	}
+	switch v := kv[i].(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return kv[i]
+}
+
+func textLogValue(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func jsonLogValue(v interface{}) interface{} {
+	switch v.(type) {
+	case string, bool, int, int64, uint64, float64, []string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func logComponents() []string {
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serveLogLevel is the handler of /loglevel: it returns the level of each
+// component, after changing it with a POST or PUT request with the level
+// parameter, for the component parameter or all components. Changes last
+// until the configuration is reloaded.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		level, err := parseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		targets := loggers
+		if name := r.FormValue("component"); name != "" {
+			if loggers[name] == nil {
+				http.Error(w, "unknown component "+strconv.Quote(name), http.StatusBadRequest)
+				return
+			}
+			targets = map[string]*logger{name: loggers[name]}
+		}
+		for name, l := range targets {
+			l.setLevel(level)
+			configLog.info("log level changed", "logger", name, "new_level", level)
+		}
+	}
+	levels := make(map[string]string)
+	for name, l := range loggers {
+		levels[name] = l.getLevel().String()
+	}
+	body, _ := json.MarshalIndent(levels, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFormat(t *testing.T) {
+	ts := time.Date(2017, 3, 4, 5, 6, 7, 8e6, time.UTC)
+	kv := []interface{}{"server", "udp/127.0.0.1:53", "error", errors.New("no route"), "count", 3, "ok", true, "list", []string{"a", "b"}}
+
+	text := (&logConfig{}).format(ts, levelWarn, "server", "starting server", kv)
+	want := `2017-03-04T05:06:07.008Z warn server: starting server server=udp/127.0.0.1:53 error="no route" count=3 ok=true list="[a b]"` + "\n"
+	if string(text) != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+
+	line := (&logConfig{json: true}).format(ts, levelError, "cache", `say "hi"`, append(kv, "missing"))
+	var got map[string]interface{}
+	if err := json.Unmarshal(line, &got); err != nil {
+		t.Fatalf("%v: %s", err, line)
+	}
+	for key, value := range map[string]interface{}{
+		"time": "2017-03-04T05:06:07.008Z", "level": "error", "component": "cache", "msg": `say "hi"`,
+		"error": "no route", "count": 3.0, "ok": true, "missing": "(missing)",
+	} {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+}
+
+func TestLogConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lresolver.log")
+
+	readTestConfig(t, `
+log_output: `+file+`
+log_format: json
+log_level: warn
+log_levels: [upstream=debug]
+`)
+	lc, err := newLogConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file is only opened when the configuration is applied
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("log opened while building the configuration: %v", err)
+	}
+	if err := lc.apply(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		readTestConfig(t, "")
+		lc, _ := newLogConfig()
+		lc.apply()
+	}()
+	upstreamLog.debug("sending query", "nameserver", "10.0.0.1:53")
+	cacheLog.info("not logged")
+	configLog.warn("logged")
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"nameserver":"10.0.0.1:53"`) || !strings.Contains(lines[1], `"msg":"logged"`) {
+		t.Errorf("unexpected log %q", lines)
+	}
+
+	// runtime changes
+	rec := httptest.NewRecorder()
+	serveLogLevel(rec, httptest.NewRequest("POST", "/loglevel?component=cache&level=debug", nil))
+	var levels map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &levels); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	want := map[string]string{"server": "warn", "cache": "debug", "upstream": "debug", "config": "warn"}
+	for name, level := range want {
+		if levels[name] != level {
+			t.Errorf("%s level = %s, want %s", name, levels[name], level)
+		}
+	}
+	for _, target := range []string{"/loglevel?level=verbose", "/loglevel?component=dns&level=info"} {
+		rec := httptest.NewRecorder()
+		serveLogLevel(rec, httptest.NewRequest("PUT", target, nil))
+		if rec.Code != 400 {
+			t.Errorf("PUT %s returned %d, want 400", target, rec.Code)
+		}
+	}
+
+	for _, config := range []string{"log_format: xml\n", "log_level: loud\n", "log_levels: [dns=info]\n"} {
+		readTestConfig(t, config)
+		if _, err := newLogConfig(); err == nil {
+			t.Errorf("expected error for %q", config)
+		}
+	}
+}
+
+func TestLogVerbosityFlag(t *testing.T) {
+	readTestConfig(t, "log_level: warn\nlog_levels: [cache=error]\n")
+	logVerbosity = 2
+	defer func() { logVerbosity = 0 }()
+	lc, err := newLogConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -v sets the default level, log_levels still wins
+	if lc.level != levelDebug || lc.levels["cache"] != levelError {
+		t.Errorf("level = %v, cache level = %v", lc.level, lc.levels["cache"])
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"container/ring"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/miekg/dns"
 	"github.com/spf13/viper"
 )
@@ -17,78 +19,212 @@ type entry struct {
 	expire   int64
 }
 
-type nameservers struct {
-	cacheOn       bool
-	negativeCache bool
-	maxCacheTTL   int64
-	canBroadcast  bool
-	slist         []string // read-only list of servers
+// responseCache is kept across configuration reloads as long as the cache
+// settings don't change.
+type responseCache struct {
+	on          bool
+	negative    bool
+	maxCacheTTL int64
+
+	mu      sync.RWMutex
+	entries map[string]entry
+}
 
-	cmu   sync.RWMutex
-	cache map[string]entry
+type nameservers struct {
+	canBroadcast bool
+	slist        []string      // read-only list of servers
+	timeout      time.Duration // query timeout, 0 uses the dns package defaults
 
 	rmu   sync.Mutex
 	sring *ring.Ring
 }
 
 var (
-	// TODO: make servers variable thread-safe to implement automatic config reload
-	servers    *nameservers
-	dnsServers map[string]*dns.Server
+	smu        sync.Mutex
+	dnsServers map[string]server
+	// servers that stopped serving on their own, with the error
+	failedServers = make(map[string]error)
 )
 
-func parseConfig() int {
-	nservers := viper.GetStringSlice("nameservers")
-	servers = &nameservers{sring: ring.New(len(nservers)), slist: make([]string, len(nservers))}
+func newNameservers(nservers []string) (*nameservers, error) {
+	servers := &nameservers{sring: ring.New(len(nservers)), slist: make([]string, len(nservers))}
 	for i := 0; i < servers.sring.Len(); i++ {
-		nameserver := fixDNSAddress(nservers[i])
+		nameserver, err := fixDNSAddress(nservers[i])
+		if err != nil {
+			return nil, fmt.Errorf("nameservers: %v", err)
+		}
 		servers.sring.Value = nameserver
 		servers.sring = servers.sring.Next()
 		servers.slist[i] = nameserver
 	}
-	servers.cacheOn = viper.GetBool("cache")
-	servers.negativeCache = viper.GetBool("negative_cache")
-	servers.maxCacheTTL = viper.GetInt64("max_cache_ttl")
-	servers.cache = make(map[string]entry)
 	servers.canBroadcast = servers.sring.Len() > 1
-	return servers.sring.Len()
+	return servers, nil
 }
 
-func dumpConfig() {
-	glog.Infoln("config: bind", viper.GetString("bind"))
-	glog.Infoln("config: tcp", viper.GetBool("tcp"))
-	glog.Infoln("config: nameservers", servers.slist)
-	glog.Infoln("config: negative_cache", servers.negativeCache)
-	glog.Infoln("config: max_cache_ttl", servers.maxCacheTTL)
+func newResponseCache() *responseCache {
+	return &responseCache{
+		on:          viper.GetBool("cache"),
+		negative:    viper.GetBool("negative_cache"),
+		maxCacheTTL: viper.GetInt64("max_cache_ttl"),
+		entries:     make(map[string]entry),
+	}
 }
 
-func startServers(listenAddr string) {
-	dnsServers := make(map[string]*dns.Server)
+// server serves one transport of a listener.
+type server interface {
+	// serve blocks serving queries, calling ready once it accepts them.
+	serve(ready func()) error
+	shutdown() error
+	// close releases the sockets of a server that never served.
+	close()
+}
 
-	for _, transport := range getTransports() {
-		dnsServers[transport] = &dns.Server{Addr: listenAddr, Net: transport}
+// startServers makes the running servers match listeners: servers no
+// longer configured are stopped and new ones are started. It binds every
+// new address before serving so an address that can't be used is reported
+// right away, and in that case none of the new servers are started.
+func startServers(listeners []*listener) error {
+	smu.Lock()
+	defer smu.Unlock()
+	if dnsServers == nil {
+		dnsServers = make(map[string]server)
 	}
-	dns.HandleFunc(".", resolve)
-	for _, server := range dnsServers {
-		go func(s *dns.Server) {
-			glog.Infoln("starting server", s.Addr, "-", s.Net)
-			if err := s.ListenAndServe(); err != nil {
-				glog.Fatalln("error starting dns server: ", err)
+
+	wanted := make(map[string]*listener)
+	for _, l := range listeners {
+		for _, transport := range l.Transports {
+			wanted[serverKey(transport, l.Address)] = l
+		}
+	}
+	for key, s := range dnsServers {
+		if wanted[key] == nil {
+			delete(dnsServers, key)
+			delete(failedServers, key)
+			shutdownServer(key, s)
+		}
+	}
+
+	started := make(map[string]server)
+	for key, l := range wanted {
+		if dnsServers[key] != nil {
+			continue
+		}
+		transport := strings.SplitN(key, "/", 2)[0]
+		s, err := listen(l, transport)
+		if err != nil {
+			for _, s := range started {
+				s.close()
 			}
-		}(server)
+			return fmt.Errorf("can't listen on %s (%s): %v", l.Address, transport, err)
+		}
+		started[key] = s
+	}
+	for key, s := range started {
+		dnsServers[key] = s
+		// wait until the server is serving so it can be shut down
+		ready := make(chan struct{})
+		var once sync.Once
+		notify := func() { once.Do(func() { close(ready) }) }
+		go func(key string, s server) {
+			serverLog.info("starting server", "server", key)
+			err := s.serve(notify)
+			notify()
+			serverStopped(key, s, err)
+		}(key, s)
+		<-ready
 	}
+	return nil
 }
 
-func stopServers() {
-	for _, server := range dnsServers {
-		glog.Infoln("shuting down server", server.Addr, "-", server.Net)
-		if err := server.Shutdown(); err != nil {
-			glog.Errorln("error shuting down server:", err)
+func serverKey(transport, addr string) string {
+	return transport + "/" + addr
+}
+
+// listen binds the address of l and returns a server for transport ready
+// to serve.
+func listen(l *listener, transport string) (server, error) {
+	addr := l.Address
+	switch transport {
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
 		}
+		return &dnsServer{&dns.Server{Addr: addr, Net: transport, PacketConn: conn, Handler: serveListener(addr)}}, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	switch transport {
+	case "tcp-tls":
+		ln = tls.NewListener(ln, listenerTLSConfig(addr))
+	case "https":
+		ln = tls.NewListener(ln, listenerTLSConfig(addr, "h2", "http/1.1"))
+		fallthrough
+	case "http":
+		return newDoHServer(addr, ln), nil
+	case "admin":
+		return newAdminServer(ln), nil
 	}
+	return &dnsServer{&dns.Server{Addr: addr, Net: transport, Listener: ln, Handler: serveListener(addr)}}, nil
+}
+
+// dnsServer serves DNS over UDP, TCP or TLS.
+type dnsServer struct {
+	*dns.Server
 }
 
-func getNameServer() string {
+func (s *dnsServer) serve(ready func()) error {
+	s.NotifyStartedFunc = ready
+	return s.ActivateAndServe()
+}
+
+func (s *dnsServer) shutdown() error {
+	return s.Shutdown()
+}
+
+func (s *dnsServer) close() {
+	if s.PacketConn != nil {
+		s.PacketConn.Close()
+	}
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+}
+
+func shutdownServer(key string, s server) {
+	serverLog.info("shutting down server", "server", key)
+	if err := s.shutdown(); err != nil {
+		serverLog.error("error shutting down server", "server", key, "error", err)
+	}
+}
+
+// serverStopped records that s stopped serving, unless it was shut down.
+func serverStopped(key string, s server, err error) {
+	smu.Lock()
+	defer smu.Unlock()
+	if dnsServers[key] != s {
+		return
+	}
+	serverLog.error("server stopped serving", "server", key, "error", err)
+	failedServers[key] = err
+}
+
+func stopServers() {
+	smu.Lock()
+	servers := dnsServers
+	dnsServers = nil
+	failedServers = make(map[string]error)
+	smu.Unlock()
+
+	for key, s := range servers {
+		shutdownServer(key, s)
+	}
+}
+
+func (servers *nameservers) getNameServer() string {
 	servers.rmu.Lock()
 	defer servers.rmu.Unlock()
 
@@ -98,79 +234,118 @@ func getNameServer() string {
 	return server
 }
 
-func getResponseFromCache(question string) *dns.Msg {
-	if !servers.cacheOn {
+// next returns the nameserver the next query will be sent to.
+func (servers *nameservers) next() string {
+	servers.rmu.Lock()
+	defer servers.rmu.Unlock()
+	return servers.sring.Value.(string)
+}
+
+// getResponse returns a copy of the cached response, which the caller may
+// change and keep after writing it.
+func (c *responseCache) getResponse(question string) *dns.Msg {
+	if !c.on {
 		return nil
 	}
-	servers.cmu.RLock()
-	defer servers.cmu.RUnlock()
-	if value, ok := servers.cache[question]; ok {
-		if value.expire < time.Now().Unix() {
-			// remove from cache now
-			// TODO: return cached value and update cache on a goroutine
-			glog.Infoln("expiring cache")
-			delete(servers.cache, question)
-			return nil
-		}
-		return value.response
+	c.mu.RLock()
+	value, ok := c.entries[question]
+	c.mu.RUnlock()
+	if !ok {
+		cacheMisses.inc()
+		return nil
 	}
-	return nil
+	if value.expire < time.Now().Unix() {
+		// remove from cache now
+		// TODO: return cached value and update cache on a goroutine
+		cacheLog.debug("expiring cache entry", "question", question)
+		c.mu.Lock()
+		delete(c.entries, question)
+		c.mu.Unlock()
+		cacheEvictions.inc()
+		cacheMisses.inc()
+		return nil
+	}
+	cacheHits.inc()
+	return value.response.Copy()
 }
 
-func updateCache(question string, response *dns.Msg) {
-	if !servers.cacheOn {
+func (c *responseCache) update(question string, response *dns.Msg) {
+	if !c.on {
 		return
 	}
 	// we respect TTL as long as it is lower than max_cache_ttl
 	now := time.Now().Unix()
-	exp := now + servers.maxCacheTTL
+	exp := now + c.maxCacheTTL
 	if len(response.Answer) > 0 {
 		ttlexp := now + int64(response.Answer[0].Header().Ttl)
 		if ttlexp < exp {
 			exp = ttlexp
 		}
 	}
-	servers.cmu.Lock()
-	defer servers.cmu.Unlock()
-	servers.cache[question] = entry{response: response, expire: exp}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the caller keeps using response
+	c.entries[question] = entry{response: response.Copy(), expire: exp}
+}
+
+func (c *responseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]entry)
 }
 
-func clearCache() {
-	servers.cmu.Lock()
-	defer servers.cmu.Unlock()
-	servers.cache = make(map[string]entry)
+func (c *responseCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
 }
 
-func getTransports() []string {
-	if viper.GetBool("tcp") {
+// sameSettings reports whether o can replace c without losing entries.
+func (c *responseCache) sameSettings(o *responseCache) bool {
+	return c.on == o.on && c.negative == o.negative && c.maxCacheTTL == o.maxCacheTTL
+}
+
+func getTransports(tcp bool) []string {
+	if tcp {
 		return []string{"udp", "tcp"}
 	}
 	return []string{"udp"}
 }
 
-func directResolve(req *dns.Msg, transport string, nameserver string) (*dns.Msg, error) {
-	client := &dns.Client{Net: transport}
-	glog.Infoln("trying to resolv", req.Question, "using", nameserver)
-	in, _, err := client.Exchange(req, nameserver)
+func (servers *nameservers) directResolve(req *dns.Msg, q *queryInfo, nameserver string) (*dns.Msg, error) {
+	client := &dns.Client{Net: q.net, Timeout: servers.timeout}
+	upstreamLog.debug("sending query", "name", req.Question[0].Name, "type", typeString(req.Question[0].Qtype), "nameserver", nameserver)
+	start := time.Now()
+	q.tap.forwarderQuery(req, q.net, nameserver, start)
+	in, rtt, err := client.Exchange(req, nameserver)
+	if err == dns.ErrTruncated && in != nil {
+		// a response the client retries over TCP
+		err = nil
+	}
+	countUpstream(nameserver, rtt, err)
+	q.addAttempt(nameserver, start, rtt, in, err)
+	q.tap.forwarderResponse(req, in, q.net, nameserver, start, rtt)
 	return in, err
 }
 
-func broadcastResolve(req *dns.Msg, transport string, usedns string) (*dns.Msg, error) {
+func (servers *nameservers) broadcastResolve(req *dns.Msg, q *queryInfo, usedns string) (*dns.Msg, error) {
 	total := len(servers.slist) - 1
 	resp := make([]*dns.Msg, total)
 	errs := make([]error, total)
+	used := make([]string, total)
 	var wg sync.WaitGroup
 	actual := 0
 	for _, nameserver := range servers.slist {
 		if nameserver == usedns {
 			// skip already used nameserver
-			glog.Infoln("used nameserver", usedns, "skipping", nameserver)
+			upstreamLog.debug("skipping nameserver already tried", "nameserver", nameserver)
 			continue
 		}
 		wg.Add(1)
+		used[actual] = nameserver
 		go func(pos int, ns string) {
 			defer wg.Done()
-			in, err := directResolve(req, transport, ns)
+			in, err := servers.directResolve(req, q, ns)
 			resp[pos] = in
 			errs[pos] = err
 		}(actual, nameserver)
@@ -182,10 +357,14 @@ func broadcastResolve(req *dns.Msg, transport string, usedns string) (*dns.Msg,
 	erroridx := 0
 	for i := 0; i < total; i++ {
 		if errs[i] == nil && !isError(resp[i]) {
+			q.setUpstream(used[i])
 			return resp[i], nil
 		}
 		erroridx = i
 	}
+	if errs[erroridx] == nil {
+		q.setUpstream(used[erroridx])
+	}
 	return resp[erroridx], errs[erroridx]
 }
 
@@ -194,49 +373,170 @@ func isError(msg *dns.Msg) bool {
 	return msg.MsgHdr.Rcode != 0
 }
 
-func resolve(w dns.ResponseWriter, req *dns.Msg) {
+// forward resolves req upstream. The first attempt uses a nameserver from
+// all possibilites using round-robin, on connection error or NXDOMAIN all
+// other nameservers are tried in parallel.
+func (servers *nameservers) forward(req *dns.Msg, q *queryInfo) (*dns.Msg, error) {
+	nameserver := servers.getNameServer()
+	in, err := servers.directResolve(req, q, nameserver)
+	// check for connection error or NXDOMAIN
+	if (err != nil || isError(in)) && servers.canBroadcast {
+		// check all nameservers for
+		upstreamBroadcasts.inc()
+		q.setBroadcast()
+		return servers.broadcastResolve(req, q, nameserver)
+	}
+	if err == nil {
+		q.setUpstream(nameserver)
+	}
+	return in, err
+}
+
+// resolveUpstream forwards req applying rewrite rules and DNS64 synthesis.
+func (cfg *runtimeConfig) resolveUpstream(req *dns.Msg, q *queryInfo) (*dns.Msg, error) {
+	if ptr := cfg.dns64.resolvePTR(cfg.servers, req, q); ptr != nil {
+		return ptr, nil
+	}
+	// rewrite rules may change the question sent upstream
+	up := req
+	rule := findRewrite(cfg.rewrites, req.Question[0].Name)
+	if rule != nil {
+		up = rule.rewriteRequest(req)
+	}
+	in, err := cfg.validator.exchange(cfg.servers, up, q)
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil {
+		in = rule.rewriteResponse(req, up, in)
+		// not the validated answer anymore
+		in.AuthenticatedData = false
+	}
+	out := cfg.dns64.synthesize(cfg.servers, req, in, q)
+	if out != in {
+		out.AuthenticatedData = false
+	}
+	return out, nil
+}
+
+// writeResponse sends the response to req, unless it is dropped by
+// response rate limiting.
+func (cfg *runtimeConfig) writeResponse(w dns.ResponseWriter, req, msg *dns.Msg) {
+	if msg = cfg.limiter.limitResponse(w, req, msg); msg != nil {
+		writeResponse(w, msg)
+	}
+}
+
+func writeResponse(w dns.ResponseWriter, msg *dns.Msg) {
+	if err := w.WriteMsg(msg); err != nil {
+		serverLog.error("error writing response to client", "error", err)
+	}
+}
+
+// resolve answers a query received on listener l. The same configuration
+// snapshot is used for the whole query.
+func (cfg *runtimeConfig) resolve(l *listener, w dns.ResponseWriter, req *dns.Msg) {
+	q, w := cfg.startQuery(l, w, req)
+	defer cfg.endQuery(q)
+
 	if len(req.Question) == 0 {
+		q.source = sourceFailed
 		dns.HandleFailed(w, req)
 		return
 	}
 
-	in := getResponseFromCache(dnsMsgToStr(req))
+	if !cfg.authorize(l, w.RemoteAddr(), req.Question[0]) {
+		serverLog.debug("unauthorized query", "name", req.Question[0].Name, "client", w.RemoteAddr())
+		q.source = sourceUnauthorized
+		if !cfg.dropUnauthorized(l) {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			cfg.writeResponse(w, req, m)
+		}
+		return
+	}
 
-	if in == nil {
-		// not found in cache, first attempt to resolv is
-		// using a nameserver from all possibilites using
-		// round-robin
-		transport := "udp"
-		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
-			transport = "tcp"
+	if limited, resp := cfg.limiter.limitQuery(w, req); limited {
+		q.source = sourceRateLimited
+		if resp != nil {
+			writeResponse(w, resp)
+		}
+		return
+	}
+
+	s := q.trace.startSpan("local records lookup", spanInternal)
+	local := cfg.records.lookup(req)
+	s.set("lresolver.found", local != nil)
+	s.finish()
+	if local != nil {
+		serverLog.debug("returning local record", "name", req.Question[0].Name)
+		q.source = sourceLocal
+		cfg.writeResponse(w, req, local)
+		return
+	}
+
+	passthru := false
+	if hit := lookupPolicy(cfg.policies, req.Question[0].Name); hit != nil {
+		serverLog.info("rpz: policy hit", "name", req.Question[0].Name, "client", w.RemoteAddr(), "zone", hit.zone, "rule", hit.trigger, "action", hit.action)
+		switch hit.action {
+		case rpzPassthru:
+			passthru = true
+		case rpzDrop:
+			q.source = sourcePolicy
+			return
+		default:
+			q.source = sourcePolicy
+			cfg.writeResponse(w, req, hit.respond(cfg.servers, req, q))
+			return
+		}
+	}
+
+	if !passthru {
+		if blocked := cfg.blocker.lookup(req); blocked != nil {
+			serverLog.debug("blocked", "name", req.Question[0].Name, "client", w.RemoteAddr())
+			q.source = sourceBlocked
+			cfg.writeResponse(w, req, blocked)
+			return
 		}
+	}
+
+	// responses not validated for CD queries aren't cached
+	cached := !cfg.validator.unchecked(req)
+	var in *dns.Msg
+	s = q.trace.startSpan("cache lookup", spanInternal)
+	if cached {
+		in = cfg.cache.getResponse(dnsMsgToStr(req))
+	}
+	s.set("lresolver.cache.hit", in != nil)
+	s.finish()
+	if cfg.cache.on && cached {
+		q.cache = "miss"
+	}
+
+	if in == nil {
 		var err error
-		var nameserver = getNameServer()
-		in, err = directResolve(req, transport, nameserver)
-		// check for connection error or NXDOMAIN
-		if (err != nil || isError(in)) && servers.canBroadcast {
-			// check all nameservers for
-			in, err = broadcastResolve(req, transport, nameserver)
-			if err != nil {
-				// we got network error from all servers ()
-				dns.HandleFailed(w, req)
-				return
-			}
+		q.source = sourceUpstream
+		in, err = cfg.resolveUpstream(req, q)
+		if err != nil {
+			// we got network error from all servers
+			q.source = sourceFailed
+			dns.HandleFailed(w, req)
+			return
 		}
 		// if response is NXDOMAIN we only cache it if
 		// negative_cache is configured
-		if !isError(in) || (isError(in) && servers.negativeCache) {
-			glog.Infoln("updating cache: valid result")
-			updateCache(dnsMsgToStr(req), in)
+		// truncated responses are completed when the client retries over TCP
+		if cached && !in.Truncated && (!isError(in) || (isError(in) && cfg.cache.negative)) {
+			cacheLog.debug("updating cache", "name", req.Question[0].Name)
+			cfg.cache.update(dnsMsgToStr(req), in)
 		}
 	} else {
-		glog.Infoln("returning cached result")
+		cacheLog.debug("returning cached result", "name", req.Question[0].Name)
+		q.source, q.cache = sourceCache, "hit"
 		in.MsgHdr.Id = req.MsgHdr.Id // huh
 	}
 
-	if err := w.WriteMsg(in); err != nil {
-		glog.Errorln("error writing response to client:", err)
-	}
+	cfg.writeResponse(w, req, cfg.validator.reply(req, in, q.transport == "udp"))
 }
 
 func dnsMsgToStr(req *dns.Msg) string {
@@ -244,10 +544,47 @@ func dnsMsgToStr(req *dns.Msg) string {
 	return req.Question[0].String()
 }
 
-func fixDNSAddress(addr string) string {
-	defaultPort := "53"
-	if !strings.Contains(addr, ":") {
-		return net.JoinHostPort(addr, defaultPort)
+// fixDNSAddress adds the default port to addr and checks the result is a
+// valid host:port address.
+func fixDNSAddress(addr string) (string, error) {
+	return fixAddress(addr, "53")
+}
+
+// fixAddress adds defaultPort to addr if it has none and validates it.
+func fixAddress(addr, defaultPort string) (string, error) {
+	switch {
+	case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+		// bracketed IPv6 address without port
+		addr = net.JoinHostPort(addr[1:len(addr)-1], defaultPort)
+	case strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "["):
+		// bare IPv6 address, e.g. ::1
+		addr = net.JoinHostPort(addr, defaultPort)
+	case !strings.Contains(addr, ":"):
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid address %q: bad port %q", addr, port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if !isHostname(host) {
+			return "", fmt.Errorf("invalid address %q: bad host %q", addr, host)
+		}
+	}
+	return addr, nil
+}
+
+func isHostname(host string) bool {
+	if strings.ContainsAny(host, " /\\@") {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
 	}
-	return addr
+	return true
 }
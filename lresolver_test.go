@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"net"
 	"testing"
 
+	"github.com/miekg/dns"
 	"github.com/spf13/viper"
 )
 
@@ -23,13 +25,60 @@ nameservers:
 	if err != nil {
 		panic(err)
 	}
-	startServers(fixDNSAddress(viper.GetString("bind")))
+	cfg, err := buildConfig()
+	if err != nil {
+		panic(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		panic(err)
+	}
 }
 
 func stop() {
 	stopServers()
 }
 
+func TestCacheHit(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{mustRR(t, req.Question[0].Name+" 60 IN A 192.0.2.10")}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	readTestConfig(t, `nameservers: ["`+pc.LocalAddr().String()+`"]`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(id uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.Id = id
+		w := &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		cfg.resolve(nil, w, req)
+		if w.msg == nil || w.msg.Id != id || len(w.msg.Answer) != 1 {
+			t.Fatalf("unexpected response to query %d: %v", id, w.msg)
+		}
+		return w.msg
+	}
+
+	first := resolve(1)
+	// responses written are not the cached message
+	first.Answer = nil
+	second := resolve(2)
+	resolve(3)
+	if first.Id != 1 || second.Id != 2 {
+		t.Errorf("cache hit changed earlier responses: ids %d, %d", first.Id, second.Id)
+	}
+}
+
 func BenchmarkCache(b *testing.B) {
 	// TODO
 }
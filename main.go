@@ -8,27 +8,34 @@ import (
 	"runtime"
 	"syscall"
 
-	"github.com/golang/glog"
 	"github.com/spf13/viper"
 )
 
 var (
-	config  string
-	version = "devel"
+	config      string
+	checkConfig bool
+	healthCheck bool
+	version     = "devel"
 )
 
 func init() {
 	flag.StringVar(&config, "config", "", "Config file")
+	flag.BoolVar(&checkConfig, "check-config", false, "Check config file, print the effective configuration and exit")
+	flag.BoolVar(&healthCheck, "healthcheck", false, "Query the running server on its first listener and exit with status 0 if it answers")
+	registerConfigFlags()
 	flag.Usage = usage
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS]\n\n", os.Args[0])
-	fmt.Fprintln(os.Stderr, "OPTIONS (none required):")
+	fmt.Fprintln(os.Stderr, "OPTIONS (none required, configuration directive flags override the configuration file):")
 	flag.PrintDefaults()
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Unless specified otherwise configuration file will be lresolver.{yml,yaml,json,toml,hcl}")
 	fmt.Fprintln(os.Stderr, "Path search for configuration file: \"/etc/lresolver/:.\"")
+	fmt.Fprintln(os.Stderr, "Configuration directives can also be set with environment variables, e.g.", envName("nameservers"))
+	fmt.Fprintln(os.Stderr, "Directives can also be kept in an etcd key/value store, see config_store")
+	fmt.Fprintln(os.Stderr, "Precedence is: flag > environment variable > configuration store > configuration file > default")
 	fmt.Fprintln(os.Stderr, "Sample configuration (YAML format):")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "# lresolver configuration begin")
@@ -40,60 +47,132 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "nameservers:")
 	fmt.Fprintln(os.Stderr, "- 8.8.8.8")
 	fmt.Fprintln(os.Stderr, "- 8.8.4.4")
+	fmt.Fprintln(os.Stderr, "records:")
+	fmt.Fprintln(os.Stderr, "- db.corp. 60 IN A 10.1.2.3")
 	fmt.Fprintln(os.Stderr, "# lresolver configuration end")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Printf("%s version %s (runtime: %s)\n", os.Args[0], version, runtime.Version())
 }
 
-func main() {
-	flag.Parse()
-
-	// defaults
-	viper.SetDefault("bind", "127.0.0.1")
-	viper.SetDefault("tcp", "true")
-	viper.SetDefault("cache", "true")
-	viper.SetDefault("negative_cache", "true")
+// setDefaults sets the default value of directives.
+func setDefaults() {
+	viper.SetDefault("tcp", true)
+	viper.SetDefault("acl_action", "refused")
+	viper.SetDefault("cache", true)
+	viper.SetDefault("negative_cache", true)
 	viper.SetDefault("max_cache_ttl", 300)
+	viper.SetDefault("block_action", "nxdomain")
+	viper.SetDefault("block_refresh", 0)
+	viper.SetDefault("dns64", false)
+	viper.SetDefault("dns64_prefix", "64:ff9b::/96")
+	viper.SetDefault("config_store_prefix", "/lresolver/")
+	viper.SetDefault("rate_limit", 0)
+	viper.SetDefault("rate_limit_action", "refused")
+	viper.SetDefault("rate_limit_ipv4_prefix", 32)
+	viper.SetDefault("rate_limit_ipv6_prefix", 64)
+	viper.SetDefault("rrl", 0)
+	viper.SetDefault("rrl_action", "truncate")
+	viper.SetDefault("query_log_max_size", 100)
+	viper.SetDefault("query_log_max_backups", 5)
+	viper.SetDefault("query_log_sample", 1)
+	viper.SetDefault("dnstap_queue_size", 10000)
+	viper.SetDefault("slow_query_ms", 500)
+	viper.SetDefault("tracing_service", "lresolver")
+	viper.SetDefault("tracing_sample", 1)
+	viper.SetDefault("health_canary", ".")
+	viper.SetDefault("dnssec", false)
+	viper.SetDefault("log_format", "text")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("top_size", 1000)
+	viper.SetDefault("top_window", 300)
+}
 
-	if config != "" {
-		viper.SetConfigFile(config)
-	} else {
-		viper.SetConfigName("lresolver")
-		viper.AddConfigPath("/etc/lresolver/")
-		viper.AddConfigPath(".")
+// loadConfig sets the defaults and reads the configuration file and the
+// configuration store, if one is configured.
+func loadConfig() error {
+	setDefaults()
+	bindConfigFlags()
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	// the whole configuration may come from flags, environment and the
+	// configuration store
+	sources = []configSource{newFileSource(config)}
+	if err := loadSources(); err != nil {
+		return err
+	}
+
+	store, err := newConfigStore()
+	if err != nil || store == nil {
+		return err
 	}
+	sources = append(sources, newKVSource(store, viper.GetString("config_store_prefix")))
+	return loadSources()
+}
 
-	glog.Infoln("using configuration file:", viper.ConfigFileUsed())
+func main() {
+	flag.Parse()
 
-	err := viper.ReadInConfig()
+	err := loadConfig()
+	if checkConfig {
+		os.Exit(checkConfigFile(err))
+	}
+	if healthCheck {
+		if err != nil {
+			fmt.Println("unhealthy: error reading configuration:", err)
+			os.Exit(1)
+		}
+		os.Exit(healthcheck())
+	}
+	// log where configured from the start, when possible
+	if lc, err := newLogConfig(); err == nil {
+		lc.apply()
+	}
+	warnIgnoredLogFlags()
 	if err != nil {
-		glog.Errorln("Fatal error reading config file", err)
+		configLog.error("fatal error reading configuration", "error", err)
 		os.Exit(1)
 	}
 
-	if parseConfig() < 1 {
-		glog.Errorln("no DNS servers configured, exiting")
-		os.Exit(2)
+	if file := configFileUsed(); file != "" {
+		configLog.info("using configuration file", "file", file)
+	} else {
+		configLog.info("no configuration file found")
+	}
+	for _, src := range sources[1:] {
+		configLog.info("using configuration source", "source", src.name())
 	}
 
-	dumpConfig()
-
-	listenAddr := fixDNSAddress(viper.GetString("bind"))
-	glog.Infoln("will listen on address:", listenAddr)
+	configMu.Lock()
+	cfg, err := buildConfig()
+	if err != nil {
+		configLog.error("invalid configuration", "error", err)
+		os.Exit(2)
+	}
 
-	startServers(listenAddr)
+	if err := applyConfig(cfg); err != nil {
+		serverLog.error("fatal error starting servers", "error", err)
+		os.Exit(1)
+	}
+	configMu.Unlock()
+	watchSources()
 
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
-	signal.Notify(sigs, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 	go func() {
 		for sig := range sigs {
 			switch sig {
 			case syscall.SIGUSR1:
-				glog.Infoln("cleaning up cache...")
-				clearCache()
+				cacheLog.info("cleaning up cache")
+				getConfig().cache.clear()
+			case syscall.SIGUSR2:
+				logStatus()
+			case syscall.SIGHUP:
+				configLog.info("reloading configuration")
+				readAndReloadConfig()
 			default:
-				glog.Info("exiting...")
+				serverLog.info("exiting")
 				done <- true
 			}
 		}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Metrics are exposed on the admin listener's /metrics in the Prometheus
+// text format. They live for the whole process, so they survive reloads.
+
+// metric writes itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by rendered labels
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		// exposed from the start, unlike counters with labels
+		c.values[""] = 0
+	}
+	return c
+}
+
+// inc adds one to the counter with the given label values.
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	key := labelString(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// delete removes the counter with the given label values.
+func (c *counterVec) delete(values ...string) {
+	c.mu.Lock()
+	delete(c.values, labelString(c.labels, values))
+	c.mu.Unlock()
+}
+
+func (c *counterVec) get(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelString(c.labels, values)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	values := make(map[string]float64, len(c.values))
+	for key, v := range c.values {
+		values[key] = v
+	}
+	c.mu.Unlock()
+	writeSamples(w, c.name, c.help, "counter", values)
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, sorted
+
+	mu     sync.Mutex
+	values map[string]*histogram // by rendered labels
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// observe records v in the histogram with the given label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelString(h.labels, values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist := h.values[key]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// delete removes the histogram with the given label values.
+func (h *histogramVec) delete(values ...string) {
+	h.mu.Lock()
+	delete(h.values, labelString(h.labels, values))
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// funcMetric is a metric whose samples are read when scraped.
+type funcMetric struct {
+	name string
+	help string
+	typ  string
+	fn   func() map[string]float64 // by rendered labels
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	writeSamples(w, f.name, f.help, f.typ, f.fn())
+}
+
+func gaugeFunc(name, help string, fn func() float64) *funcMetric {
+	return &funcMetric{name: name, help: help, typ: "gauge", fn: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}}
+}
+
+func writeSamples(w io.Writer, name, help, typ string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, key, formatFloat(values[key]))
+	}
+}
+
+// labelString renders label pairs as {name="value",...}.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabel(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to rendered labels.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+var (
+	queriesInFlight int64
+
+	queriesTotal = newCounterVec("lresolver_queries_total",
+		"Client queries by transport, query type and response code.", "transport", "qtype", "rcode")
+	queryDuration = newHistogramVec("lresolver_query_duration_seconds",
+		"Time to answer client queries.", latencyBuckets, "transport")
+
+	cacheHits = newCounterVec("lresolver_cache_hits_total",
+		"Queries answered from the cache.")
+	cacheMisses = newCounterVec("lresolver_cache_misses_total",
+		"Queries not found in the cache.")
+	cacheEvictions = newCounterVec("lresolver_cache_evictions_total",
+		"Expired responses removed from the cache.")
+
+	upstreamQueries = newCounterVec("lresolver_upstream_queries_total",
+		"Queries sent to each nameserver.", "server")
+	upstreamErrors = newCounterVec("lresolver_upstream_errors_total",
+		"Queries to each nameserver that failed, excluding timeouts.", "server")
+	upstreamTimeouts = newCounterVec("lresolver_upstream_timeouts_total",
+		"Queries to each nameserver that timed out.", "server")
+	upstreamRTT = newHistogramVec("lresolver_upstream_rtt_seconds",
+		"Round trip time of the queries answered by each nameserver.", latencyBuckets, "server")
+	upstreamBroadcasts = newCounterVec("lresolver_upstream_broadcasts_total",
+		"Queries sent to all other nameservers after the first one failed.")
+
+	dnstapSent = newCounterVec("lresolver_dnstap_sent_total",
+		"dnstap messages sent.")
+	dnstapDropped = newCounterVec("lresolver_dnstap_dropped_total",
+		"dnstap messages dropped because the queue was full or the output unavailable.")
+	tracesSent = newCounterVec("lresolver_traces_sent_total",
+		"Query traces sent to the tracing collector.")
+	tracesDropped = newCounterVec("lresolver_traces_dropped_total",
+		"Query traces dropped because the queue was full or the collector failed.")
+	dnssecResults = newCounterVec("lresolver_dnssec_validations_total",
+		"Upstream responses validated with dnssec, by result: secure, insecure or bogus.", "result")
+)
+
+var metrics = []metric{
+	&funcMetric{
+		name: "lresolver_build_info",
+		help: "Version of lresolver, as a label.",
+		typ:  "gauge",
+		fn: func() map[string]float64 {
+			return map[string]float64{labelString([]string{"version"}, []string{version}): 1}
+		},
+	},
+	queriesTotal,
+	queryDuration,
+	gaugeFunc("lresolver_queries_in_flight", "Client queries being answered.", func() float64 {
+		return float64(atomic.LoadInt64(&queriesInFlight))
+	}),
+	&funcMetric{
+		name: "lresolver_rate_limited_total",
+		help: "Queries and responses limited by rate_limit and rrl, by action.",
+		typ:  "counter",
+		fn:   rateLimitedSamples,
+	},
+	cacheHits,
+	cacheMisses,
+	cacheEvictions,
+	gaugeFunc("lresolver_cache_entries", "Responses in the cache.", func() float64 {
+		cfg, _ := current.Load().(*runtimeConfig)
+		if cfg == nil {
+			return 0
+		}
+		return float64(cfg.cache.size())
+	}),
+	upstreamQueries,
+	upstreamErrors,
+	upstreamTimeouts,
+	upstreamRTT,
+	upstreamBroadcasts,
+	dnstapSent,
+	dnstapDropped,
+	tracesSent,
+	tracesDropped,
+	dnssecResults,
+	&funcMetric{
+		name: "lresolver_top_queries",
+		help: "Queries of the most counted keys of each top list over top_window.",
+		typ:  "gauge",
+		fn:   topSamples,
+	},
+}
+
+func rateLimitedSamples() map[string]float64 {
+	samples := make(map[string]float64)
+	for key, n := range limitedCounts() {
+		parts := strings.SplitN(key, "_", 2)
+		samples[labelString([]string{"type", "action"}, parts)] = float64(n)
+	}
+	return samples
+}
+
+// serveMetrics is the handler of /metrics.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	buf.Flush()
+}
+
+func queryStarted() {
+	atomic.AddInt64(&queriesInFlight, 1)
+}
+
+// countQuery records a client query once done.
+func countQuery(q *queryInfo) {
+	atomic.AddInt64(&queriesInFlight, -1)
+	qtype := "NONE"
+	if len(q.req.Question) > 0 {
+		qtype = metricType(q.req.Question[0].Qtype)
+	}
+	rcode := "dropped"
+	if q.resp != nil {
+		rcode = rcodeString(q.resp.Rcode)
+	}
+	queriesTotal.inc(q.transport, qtype, rcode)
+	queryDuration.observe(time.Since(q.start).Seconds(), q.transport)
+}
+
+// metricTypes are the query types with their own qtype label, so clients
+// can't create a series for each of the 65536 types.
+var metricTypes = map[uint16]bool{
+	dns.TypeA: true, dns.TypeAAAA: true, dns.TypeANY: true, dns.TypeCAA: true,
+	dns.TypeCNAME: true, dns.TypeDNSKEY: true, dns.TypeDS: true, dns.TypeMX: true,
+	dns.TypeNAPTR: true, dns.TypeNS: true, dns.TypePTR: true, dns.TypeSOA: true,
+	dns.TypeSRV: true, dns.TypeTXT: true,
+}
+
+// metricType returns the qtype label of qtype, OTHER for the types not in
+// metricTypes.
+func metricType(qtype uint16) string {
+	if !metricTypes[qtype] {
+		return "OTHER"
+	}
+	return typeString(qtype)
+}
+
+func typeString(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return strconv.Itoa(rcode)
+}
+
+// countUpstream records a query sent to nameserver.
+func countUpstream(nameserver string, rtt time.Duration, err error) {
+	upstreamQueries.inc(nameserver)
+	ne, ok := err.(net.Error)
+	timeout := ok && ne.Timeout()
+	recordUpstream(nameserver, rtt, err, timeout)
+	switch {
+	case err == nil:
+		upstreamRTT.observe(rtt.Seconds(), nameserver)
+	case timeout:
+		upstreamTimeouts.inc(nameserver)
+	default:
+		upstreamErrors.inc(nameserver)
+	}
+}
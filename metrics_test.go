@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "server", "code")
+	c.inc("10.0.0.1:53", "a")
+	c.inc("10.0.0.1:53", "a")
+	c.inc(`quo"te`, "b")
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{.1, 1}, "server")
+	h.observe(.05, "x")
+	h.observe(.5, "x")
+	h.observe(5, "x")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	h.write(&buf)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{server="10.0.0.1:53",code="a"} 2
+test_total{server="quo\"te",code="b"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{server="x",le="0.1"} 1
+test_seconds_bucket{server="x",le="1"} 2
+test_seconds_bucket{server="x",le="+Inf"} 3
+test_seconds_sum{server="x"} 5.55
+test_seconds_count{server="x"} 3
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+records:
+- db.corp. 60 IN A 10.1.2.3
+acl:
+- networks: [192.0.2.0/24]
+  qtypes: [A]
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(ip string, qtype uint16) {
+		req := new(dns.Msg)
+		req.SetQuestion("db.corp.", qtype)
+		cfg.resolve(nil, &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip)}}, req)
+	}
+	ok := queriesTotal.get("udp", "A", "NOERROR")
+	refused := queriesTotal.get("udp", "AAAA", "REFUSED")
+	other := queriesTotal.get("udp", "OTHER", "REFUSED")
+	query("192.0.2.1", dns.TypeA)
+	query("192.0.2.1", dns.TypeAAAA)
+	query("192.0.2.1", 65000)
+	query("192.0.2.1", dns.TypeHINFO)
+	if got := queriesTotal.get("udp", "A", "NOERROR"); got != ok+1 {
+		t.Errorf("NOERROR queries = %v, want %v", got, ok+1)
+	}
+	if got := queriesTotal.get("udp", "AAAA", "REFUSED"); got != refused+1 {
+		t.Errorf("REFUSED queries = %v, want %v", got, refused+1)
+	}
+	// uncommon types share one label
+	if got := queriesTotal.get("udp", "OTHER", "REFUSED"); got != other+2 {
+		t.Errorf("OTHER queries = %v, want %v", got, other+2)
+	}
+	if got := queriesTotal.get("udp", "TYPE65000", "REFUSED"); got != 0 {
+		t.Errorf("TYPE65000 has its own series")
+	}
+
+	countUpstream("10.0.0.1:53", 0, &net.OpError{Op: "read", Err: timeoutError{}})
+	if upstreamTimeouts.get("10.0.0.1:53") == 0 || upstreamErrors.get("10.0.0.1:53") != 0 {
+		t.Error("timeout not counted as such")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestAdminListener(t *testing.T) {
+	addr := freeTCPAddr(t)
+	readTestConfig(t, "admin_bind: 127.0.0.1\n")
+	list, err := parseListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := list[len(list)-1]; l.Address != "127.0.0.1:"+adminPort || l.Transports[0] != "admin" {
+		t.Errorf("unexpected admin listener %s %v", l.Address, l.Transports)
+	}
+	readTestConfig(t, "admin_bind: \""+addr+"\"\nlisteners: [{address: \""+addr+"\", transports: [tcp]}]\n")
+	if _, err := parseListeners(); err == nil {
+		t.Error("expected error for admin_bind on a listener address")
+	}
+
+	admin := freeTCPAddr(t)
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+listeners: [{address: "`+addr+`", transports: [tcp]}]
+admin_bind: "`+admin+`"
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServers()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + admin + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, want := range []string{
+		"# TYPE lresolver_queries_total counter",
+		`lresolver_build_info{version="devel"} 1`,
+		"lresolver_cache_entries 0",
+		`lresolver_rate_limited_total{type="queries",action="refused"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// how a query was answered
+const (
+	sourceLocal        = "local"
+	sourceCache        = "cache"
+	sourceUpstream     = "upstream"
+	sourceBlocked      = "blocked"
+	sourcePolicy       = "rpz"
+	sourceUnauthorized = "unauthorized"
+	sourceRateLimited  = "rate_limited"
+	sourceFailed       = "failed"
+)
+
+// queryInfo is what is known about a client query while it is answered.
+// It is passed down to the upstream queries and used by the metrics and
+// the query log once the query is done.
+type queryInfo struct {
+	start     time.Time
+	req       *dns.Msg
+	client    net.Addr
+	local     net.Addr
+	transport string // client transport: udp, tcp, tcp-tls, https or http
+	net       string // upstream transport: udp or tcp
+	source    string
+	cache     string // hit or miss, empty if the cache wasn't used
+	resp      *dns.Msg
+	tap       *dnstapOutput
+	trace     *trace // nil if not traced
+
+	mu        sync.Mutex // upstream queries may be sent in parallel
+	attempts  []upstreamAttempt
+	upstream  string // nameserver whose response was used
+	broadcast bool   // all nameservers were tried after the first one failed
+}
+
+// upstreamAttempt is a query sent to a nameserver.
+type upstreamAttempt struct {
+	server string
+	start  time.Time
+	rtt    time.Duration
+	rcode  int // -1 on error
+	err    error
+}
+
+// queryWriter keeps the response written in the query info.
+type queryWriter struct {
+	dns.ResponseWriter
+	q *queryInfo
+}
+
+func (w *queryWriter) WriteMsg(m *dns.Msg) error {
+	w.q.resp = m
+	s := w.q.trace.startSpan("write response", spanInternal)
+	defer s.finish()
+	err := w.ResponseWriter.WriteMsg(m)
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// startQuery returns the info of a query received on listener l and the
+// writer to answer it with.
+func (cfg *runtimeConfig) startQuery(l *listener, w dns.ResponseWriter, req *dns.Msg) (*queryInfo, dns.ResponseWriter) {
+	q := &queryInfo{
+		start:     time.Now(),
+		req:       req,
+		client:    w.RemoteAddr(),
+		local:     w.LocalAddr(),
+		transport: queryTransport(l, w),
+		net:       "udp",
+		tap:       cfg.dnstap,
+	}
+	q.trace = cfg.tracer.newTrace(q.start)
+	if _, ok := q.client.(*net.TCPAddr); ok {
+		q.net = "tcp"
+	}
+	queryStarted()
+	cfg.dnstap.clientQuery(q)
+	return q, &queryWriter{ResponseWriter: w, q: q}
+}
+
+// endQuery records a query once answered (or dropped).
+func (cfg *runtimeConfig) endQuery(q *queryInfo) {
+	countQuery(q)
+	cfg.top.count(q)
+	cfg.queryLog.log(q)
+	cfg.slowLog.log(q)
+	cfg.dnstap.clientResponse(q)
+	if q.trace != nil {
+		q.endTrace()
+		cfg.tracer.export(q.trace)
+	}
+}
+
+// endTrace ends the root span of the trace of q.
+func (q *queryInfo) endTrace() {
+	s := q.trace.root
+	s.end = time.Now()
+	if len(q.req.Question) > 0 {
+		s.set("dns.question.name", q.req.Question[0].Name)
+		s.set("dns.question.type", typeString(q.req.Question[0].Qtype))
+	}
+	if q.client != nil {
+		s.set("client.address", q.client.String())
+	}
+	s.set("network.transport", q.transport)
+	s.set("lresolver.source", q.source)
+	if q.resp != nil {
+		s.set("dns.response.code", rcodeString(q.resp.Rcode))
+		s.set("dns.answers", len(q.resp.Answer))
+	} else {
+		s.set("dns.response.code", "dropped")
+	}
+	if q.source == sourceFailed {
+		s.err = "no nameserver answered"
+	}
+}
+
+// queryTransport returns the transport a query was received on. Listeners
+// using tcp-tls, https or http can't have other transports.
+func queryTransport(l *listener, w dns.ResponseWriter) string {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	if l != nil && len(l.Transports) == 1 && l.Transports[0] != "udp" {
+		return l.Transports[0]
+	}
+	return "tcp"
+}
+
+func (q *queryInfo) addAttempt(server string, start time.Time, rtt time.Duration, in *dns.Msg, err error) {
+	a := upstreamAttempt{server: server, start: start, rtt: rtt, rcode: -1, err: err}
+	if err == nil {
+		a.rcode = in.Rcode
+	} else {
+		// no round trip time on errors
+		a.rtt = time.Since(start)
+	}
+	q.mu.Lock()
+	q.attempts = append(q.attempts, a)
+	q.mu.Unlock()
+
+	if q.trace != nil {
+		s := &span{name: "upstream query", kind: spanClient, start: start, end: start.Add(a.rtt)}
+		s.set("server.address", server)
+		s.set("network.transport", q.net)
+		if err != nil {
+			s.fail(err)
+		} else {
+			s.set("dns.response.code", rcodeString(a.rcode))
+		}
+		q.trace.add(s)
+	}
+}
+
+func (q *queryInfo) setUpstream(server string) {
+	q.mu.Lock()
+	q.upstream = server
+	q.mu.Unlock()
+}
+
+func (q *queryInfo) setBroadcast() {
+	q.mu.Lock()
+	q.broadcast = true
+	q.mu.Unlock()
+}
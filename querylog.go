@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// queryEvent is the query log record of a client query.
+type queryEvent struct {
+	Time      string   `json:"time"`
+	Client    string   `json:"client"`
+	Transport string   `json:"transport"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Rcode     string   `json:"rcode"`
+	Answers   []string `json:"answers,omitempty"`
+	Source    string   `json:"source"`
+	Cache     string   `json:"cache,omitempty"`
+	Upstream  string   `json:"upstream,omitempty"`
+	Fallback  bool     `json:"fallback,omitempty"`
+	LatencyMS float64  `json:"latency_ms"`
+}
+
+func newQueryEvent(q *queryInfo) *queryEvent {
+	e := &queryEvent{
+		Time:      q.start.UTC().Format(time.RFC3339Nano),
+		Transport: q.transport,
+		Rcode:     "dropped",
+		Source:    q.source,
+		Cache:     q.cache,
+		LatencyMS: float64(time.Since(q.start)) / float64(time.Millisecond),
+	}
+	if q.client != nil {
+		e.Client = q.client.String()
+	}
+	if len(q.req.Question) > 0 {
+		e.Name = q.req.Question[0].Name
+		e.Type = typeString(q.req.Question[0].Qtype)
+	}
+	if q.resp != nil {
+		e.Rcode = rcodeString(q.resp.Rcode)
+		for _, rr := range q.resp.Answer {
+			// type and data, e.g. "A 10.1.2.3"
+			h := rr.Header()
+			e.Answers = append(e.Answers, typeString(h.Rrtype)+" "+strings.TrimPrefix(rr.String(), h.String()))
+		}
+	}
+	q.mu.Lock()
+	e.Upstream, e.Fallback = q.upstream, q.broadcast
+	q.mu.Unlock()
+	return e
+}
+
+// lineSink is where query log and log lines are written.
+type lineSink interface {
+	write(line []byte) error
+	close() error
+}
+
+// queryLog writes a JSON line per client query (`query_log`), logging one
+// out of `query_log_sample` queries and skipping the names under the
+// `query_log_exclude` domains.
+type queryLog struct {
+	target     string
+	maxSize    int64
+	maxBackups int
+	sample     uint64
+	exclude    *domainTrie
+
+	sink    lineSink
+	counter uint64
+}
+
+func newQueryLog() (*queryLog, error) {
+	ql := &queryLog{
+		target:     viper.GetString("query_log"),
+		maxSize:    viper.GetInt64("query_log_max_size") * 1024 * 1024,
+		maxBackups: viper.GetInt("query_log_max_backups"),
+		sample:     uint64(viper.GetInt("query_log_sample")),
+		exclude:    newDomainTrie(),
+	}
+	if ql.sample < 1 {
+		return nil, fmt.Errorf("query_log_sample: must be at least 1, got %d", ql.sample)
+	}
+	for _, domain := range configStrings("query_log_exclude") {
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return nil, fmt.Errorf("query_log_exclude: invalid domain %q", domain)
+		}
+		ql.exclude.insert(domain)
+	}
+	return ql, nil
+}
+
+// openSink opens syslog (`syslog` or `syslog:address`) or a file.
+func openSink(target string, maxSize int64, maxBackups int) (lineSink, error) {
+	if target == "syslog" || strings.HasPrefix(target, "syslog:") {
+		return newSyslogSink(strings.TrimPrefix(strings.TrimPrefix(target, "syslog"), ":"))
+	}
+	return newFileSink(target, maxSize, maxBackups)
+}
+
+// sameSink reports whether o writes to the same sink as ql, so a reload
+// can keep the open sink.
+func (ql *queryLog) sameSink(o *queryLog) bool {
+	return ql.target == o.target && ql.maxSize == o.maxSize && ql.maxBackups == o.maxBackups
+}
+
+// open opens the sink of ql when the configuration is applied, reusing the
+// one of old, which may be nil, when it didn't change so the file stays
+// open across reloads. If the new sink can't be opened the one of old is
+// kept.
+func (ql *queryLog) open(old *queryLog) error {
+	if old != nil && old.sameSink(ql) {
+		ql.sink = old.sink
+		return nil
+	}
+	var err error
+	switch ql.target {
+	case "":
+	case "stdout":
+		ql.sink = &writerSink{f: os.Stdout}
+	default:
+		ql.sink, err = openSink(ql.target, ql.maxSize, ql.maxBackups)
+	}
+	if err != nil {
+		if old != nil {
+			ql.target, ql.maxSize, ql.maxBackups, ql.sink = old.target, old.maxSize, old.maxBackups, old.sink
+		}
+		return fmt.Errorf("query_log: %v", err)
+	}
+	return nil
+}
+
+// closeSink closes the sink of ql unless cur uses it.
+func (ql *queryLog) closeSink(cur *queryLog) {
+	if ql.sink != nil && ql.sink != cur.sink {
+		ql.sink.close()
+	}
+}
+
+func (ql *queryLog) log(q *queryInfo) {
+	if ql.sink == nil {
+		return
+	}
+	if len(q.req.Question) > 0 && ql.exclude.match(q.req.Question[0].Name) {
+		return
+	}
+	if ql.sample > 1 && atomic.AddUint64(&ql.counter, 1)%ql.sample != 0 {
+		return
+	}
+	line, err := json.Marshal(newQueryEvent(q))
+	if err != nil {
+		serverLog.error("query log: error encoding query", "error", err)
+		return
+	}
+	if err := ql.sink.write(append(line, '\n')); err != nil {
+		serverLog.error("query log: error writing", "target", ql.target, "error", err)
+	}
+}
+
+// writerSink writes to a standard stream.
+type writerSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (s *writerSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.f.Write(line)
+	return err
+}
+
+func (s *writerSink) close() error {
+	return nil
+}
+
+// fileSink appends to a file, rotating it once it reaches maxSize: the
+// file is renamed to file.1, file.1 to file.2 and so on, keeping up to
+// maxBackups old files.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileSink) write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		// closed by a reload
+		return nil
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			serverLog.error("query log: error rotating", "file", s.path, "error", err)
+			if s.f == nil {
+				return err
+			}
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	s.f.Close()
+	var err error
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+		}
+		err = os.Rename(s.path, s.path+".1")
+	} else {
+		err = os.Truncate(s.path, 0)
+	}
+	if openErr := s.open(); openErr != nil {
+		s.f = nil
+		return openErr
+	}
+	return err
+}
+
+func (s *fileSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// syslogSink sends each line to syslog: the local syslog daemon, a unix
+// socket (address starting with /) or a server over UDP (host:port).
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(addr string) (*syslogSink, error) {
+	network := ""
+	if strings.HasPrefix(addr, "/") {
+		network = "unixgram"
+	} else if addr != "" {
+		network = "udp"
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "lresolver")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) write(line []byte) error {
+	return s.w.Info(strings.TrimSuffix(string(line), "\n"))
+}
+
+// writeLevel writes a log line with the severity of level.
+func (s *syslogSink) writeLevel(level logLevel, line []byte) error {
+	m := strings.TrimSuffix(string(line), "\n")
+	switch level {
+	case levelDebug:
+		return s.w.Debug(m)
+	case levelWarn:
+		return s.w.Warning(m)
+	case levelError:
+		return s.w.Err(m)
+	}
+	return s.w.Info(m)
+}
+
+func (s *syslogSink) close() error {
+	return s.w.Close()
+}
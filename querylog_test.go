@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.log")
+
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+records:
+- db.corp. 60 IN A 10.1.2.3
+- health.corp. 60 IN A 10.1.2.4
+query_log: `+path+`
+query_log_exclude: [health.corp]
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sink is only opened when the configuration is applied
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("query log opened while building the configuration: %v", err)
+	}
+	if err := cfg.queryLog.open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.queryLog.sink.close()
+	query := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		cfg.resolve(nil, &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}, req)
+	}
+	query("db.corp.")
+	query("health.corp.")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %q", data)
+	}
+	var e queryEvent
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Client != "192.0.2.1:5353" || e.Transport != "udp" || e.Name != "db.corp." || e.Type != "A" ||
+		e.Rcode != "NOERROR" || e.Source != sourceLocal || len(e.Answers) != 1 || e.Answers[0] != "A 10.1.2.3" {
+		t.Errorf("unexpected event %s", lines[0])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, e.Time); err != nil {
+		t.Errorf("invalid time %q", e.Time)
+	}
+
+	// sampling
+	cfg.queryLog.sample = 2
+	for i := 0; i < 4; i++ {
+		query("db.corp.")
+	}
+	data, _ = ioutil.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Errorf("expected 3 lines with sampling, got %d", n)
+	}
+
+	// a sink that can't be opened keeps the current one
+	readTestConfig(t, "query_log: "+filepath.Join(dir, "missing", "queries.log")+"\n")
+	next, err := newQueryLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := next.open(cfg.queryLog); err == nil || next.sink != cfg.queryLog.sink || next.target != path {
+		t.Errorf("expected the current sink to be kept, got %v, %s", err, next.target)
+	}
+
+	readTestConfig(t, "query_log_sample: 0\n")
+	if _, err := buildConfig(); err == nil {
+		t.Error("expected error for query_log_sample 0")
+	}
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.log")
+
+	s, err := newFileSink(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if err := s.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if data, _ := ioutil.ReadFile(file); string(data) != want {
+			t.Errorf("%s = %q, want %q", file, data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("more backups than configured")
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := newSyslogSink(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.write([]byte(`{"name":"db.corp."}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.Contains(msg, "lresolver") || !strings.HasSuffix(strings.TrimSpace(msg), `{"name":"db.corp."}`) {
+		t.Errorf("unexpected syslog message %q", msg)
+	}
+}
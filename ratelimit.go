@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// actions taken on rate limited queries and responses
+const (
+	limitDrop = iota
+	limitTruncate
+	limitRefused
+	numLimitActions
+)
+
+var limitActionNames = [numLimitActions]string{"drop", "truncate", "refused"}
+
+// limitedQueries and limitedResponses count the queries and responses
+// limited by each action since start up. They survive reloads.
+var limitedQueries, limitedResponses [numLimitActions]uint64
+
+// bucketIdle is how long an unused bucket is kept.
+const bucketIdle = time.Minute
+
+// tokenBucket allows rate events per second with bursts of up to burst.
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	limiting bool // logged as limited since the bucket was last full
+}
+
+// bucketSet holds the token buckets of every client prefix (or client
+// prefix and response for RRL).
+type bucketSet struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newBucketSet(rate, burst int) *bucketSet {
+	if burst < rate {
+		burst = rate
+	}
+	return &bucketSet{rate: float64(rate), burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// take removes a token from the bucket of key, reporting whether there was
+// one. The second result is true the first time key gets limited.
+func (s *bucketSet) take(key string, now time.Time) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > bucketIdle {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.rate
+	if b.tokens >= s.burst {
+		b.tokens, b.limiting = s.burst, false
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+	first := !b.limiting
+	b.limiting = true
+	return false, first
+}
+
+// sweep forgets idle buckets, which would be full again anyway.
+func (s *bucketSet) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.last) > bucketIdle {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// rateLimiter limits the queries of each client prefix (`rate_limit`) and
+// the identical responses sent to it (`rrl`), which mitigates reflection
+// attacks using spoofed sources.
+type rateLimiter struct {
+	queries     *bucketSet
+	responses   *bucketSet
+	queryAction int
+	rrlAction   int
+	ipv4Prefix  int
+	ipv6Prefix  int
+	exempt      []*net.IPNet
+}
+
+func parseLimitAction(s string) (int, error) {
+	for action, name := range limitActionNames {
+		if strings.ToLower(s) == name {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid action %q, expected drop, truncate or refused", s)
+}
+
+func newRateLimiter() (*rateLimiter, error) {
+	rl := &rateLimiter{
+		ipv4Prefix: viper.GetInt("rate_limit_ipv4_prefix"),
+		ipv6Prefix: viper.GetInt("rate_limit_ipv6_prefix"),
+	}
+	if rl.ipv4Prefix < 1 || rl.ipv4Prefix > 32 {
+		return nil, fmt.Errorf("rate_limit_ipv4_prefix: must be between 1 and 32, got %d", rl.ipv4Prefix)
+	}
+	if rl.ipv6Prefix < 1 || rl.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("rate_limit_ipv6_prefix: must be between 1 and 128, got %d", rl.ipv6Prefix)
+	}
+	var err error
+	if rl.queryAction, err = parseLimitAction(viper.GetString("rate_limit_action")); err != nil {
+		return nil, fmt.Errorf("rate_limit_action: %v", err)
+	}
+	if rl.rrlAction, err = parseLimitAction(viper.GetString("rrl_action")); err != nil {
+		return nil, fmt.Errorf("rrl_action: %v", err)
+	}
+	for _, cidr := range configStrings("rate_limit_exempt") {
+		ipnet, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("rate_limit_exempt: %v", err)
+		}
+		rl.exempt = append(rl.exempt, ipnet)
+	}
+	if rate := viper.GetInt("rate_limit"); rate > 0 {
+		rl.queries = newBucketSet(rate, viper.GetInt("rate_limit_burst"))
+	}
+	if rate := viper.GetInt("rrl"); rate > 0 {
+		rl.responses = newBucketSet(rate, viper.GetInt("rrl_burst"))
+	}
+	return rl, nil
+}
+
+// sameSettings reports whether o can replace rl keeping the buckets.
+func (rl *rateLimiter) sameSettings(o *rateLimiter) bool {
+	same := func(a, b *bucketSet) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a.rate == b.rate && a.burst == b.burst
+	}
+	return same(rl.queries, o.queries) && same(rl.responses, o.responses) &&
+		rl.ipv4Prefix == o.ipv4Prefix && rl.ipv6Prefix == o.ipv6Prefix
+}
+
+// keepBuckets makes rl use the buckets of old when the limits didn't
+// change, so a reload doesn't reset them.
+func (rl *rateLimiter) keepBuckets(old *rateLimiter) {
+	if old != nil && old.sameSettings(rl) {
+		rl.queries, rl.responses = old.queries, old.responses
+	}
+}
+
+// clientPrefix returns the network of the client, or "" if it is exempt.
+func (rl *rateLimiter) clientPrefix(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return ""
+	}
+	for _, ipnet := range rl.exempt {
+		if ipnet.Contains(ip) {
+			return ""
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rl.ipv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rl.ipv6Prefix, 128)).String()
+}
+
+// limitQuery reports whether the client is over its query rate and, if
+// so, the response to send instead (nil to drop the query).
+func (rl *rateLimiter) limitQuery(w dns.ResponseWriter, req *dns.Msg) (limited bool, resp *dns.Msg) {
+	if rl.queries == nil {
+		return false, nil
+	}
+	prefix := rl.clientPrefix(w.RemoteAddr())
+	if prefix == "" {
+		return false, nil
+	}
+	ok, first := rl.queries.take(prefix, time.Now())
+	if ok {
+		return false, nil
+	}
+	if first {
+		serverLog.warn("rate limiting queries", "client", prefix, "limited", limitedCounts())
+	}
+	atomic.AddUint64(&limitedQueries[rl.queryAction], 1)
+	return true, limitedResponse(rl.queryAction, w, req)
+}
+
+// limitResponse returns the response to send instead of resp when too many
+// identical responses went to the client's network, resp otherwise. Only
+// UDP responses are limited since TCP sources can't be spoofed.
+func (rl *rateLimiter) limitResponse(w dns.ResponseWriter, req, resp *dns.Msg) *dns.Msg {
+	if rl.responses == nil || len(resp.Question) == 0 {
+		return resp
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return resp
+	}
+	prefix := rl.clientPrefix(w.RemoteAddr())
+	if prefix == "" {
+		return resp
+	}
+	q := resp.Question[0]
+	key := fmt.Sprintf("%s/%s/%d/%d", prefix, strings.ToLower(q.Name), q.Qtype, resp.Rcode)
+	ok, first := rl.responses.take(key, time.Now())
+	if ok {
+		return resp
+	}
+	if first {
+		serverLog.warn("rate limiting responses", "name", q.Name, "client", prefix, "limited", limitedCounts())
+	}
+	atomic.AddUint64(&limitedResponses[rl.rrlAction], 1)
+	return limitedResponse(rl.rrlAction, w, req)
+}
+
+// limitedResponse returns the response for a limited query, or nil to drop
+// it. Truncated responses make legitimate clients retry over TCP.
+func limitedResponse(action int, w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	switch action {
+	case limitTruncate:
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.SetReply(req)
+			m.Truncated = true
+			return m
+		}
+		fallthrough
+	case limitRefused:
+		m.SetRcode(req, dns.RcodeRefused)
+		return m
+	}
+	return nil
+}
+
+// limitedCounts returns the number of limited queries and responses by
+// action.
+func limitedCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for action, name := range limitActionNames {
+		counts["queries_"+name] = atomic.LoadUint64(&limitedQueries[action])
+		counts["responses_"+name] = atomic.LoadUint64(&limitedResponses[action])
+	}
+	return counts
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBucketSet(t *testing.T) {
+	s := newBucketSet(2, 4)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if ok, _ := s.take("a", now); !ok {
+			t.Fatalf("burst: take %d failed", i)
+		}
+	}
+	ok, first := s.take("a", now)
+	if ok || !first {
+		t.Errorf("take over burst = %v, %v; want false, true", ok, first)
+	}
+	if _, first := s.take("a", now); first {
+		t.Error("limited twice reported as first")
+	}
+	// other keys have their own bucket
+	if ok, _ := s.take("b", now); !ok {
+		t.Error("take for another key failed")
+	}
+	// two tokens per second
+	if ok, _ := s.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("take after refill failed")
+	}
+	if ok, _ := s.take("a", now.Add(500*time.Millisecond)); ok {
+		t.Error("take over refill succeeded")
+	}
+
+	s.take("c", now)
+	s.take("a", now.Add(2*bucketIdle))
+	if _, ok := s.buckets["c"]; ok {
+		t.Error("idle bucket not swept")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	readTestConfig(t, `
+rate_limit: 1
+rate_limit_burst: 2
+rate_limit_ipv4_prefix: 24
+rate_limit_exempt: [10.0.0.0/8]
+rrl: 1
+rrl_action: truncate
+`)
+	rl, err := newRateLimiter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	udp := func(ip string) dns.ResponseWriter {
+		return &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}}
+	}
+	tcp := func(ip string) dns.ResponseWriter {
+		return &dohResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5353}}
+	}
+
+	before := limitedCounts()["queries_refused"]
+	// clients of the same /24 share the bucket
+	for i, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if limited, _ := rl.limitQuery(udp(ip), req); limited {
+			t.Fatalf("query %d limited", i)
+		}
+	}
+	limited, resp := rl.limitQuery(udp("192.0.2.3"), req)
+	if !limited || resp == nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED over the rate, got %v %v", limited, resp)
+	}
+	if got := limitedCounts()["queries_refused"]; got != before+1 {
+		t.Errorf("queries_refused = %d, want %d", got, before+1)
+	}
+	if limited, _ := rl.limitQuery(udp("198.51.100.1"), req); limited {
+		t.Error("query from another network limited")
+	}
+	for i := 0; i < 5; i++ {
+		if limited, _ := rl.limitQuery(udp("10.1.2.3"), req); limited {
+			t.Fatal("exempt client limited")
+		}
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(req)
+	if out := rl.limitResponse(udp("203.0.113.1"), req, answer); out != answer {
+		t.Error("first response limited")
+	}
+	out := rl.limitResponse(udp("203.0.113.1"), req, answer)
+	if out == nil || !out.Truncated || len(out.Answer) != 0 {
+		t.Errorf("expected truncated response, got %v", out)
+	}
+	// TCP sources can't be spoofed
+	for i := 0; i < 3; i++ {
+		if out := rl.limitResponse(tcp("203.0.113.1"), req, answer); out != answer {
+			t.Fatal("TCP response limited")
+		}
+	}
+
+	for _, yamlConfig := range []string{"rate_limit_action: slow\n", "rate_limit_ipv4_prefix: 33\n"} {
+		readTestConfig(t, yamlConfig)
+		if _, err := newRateLimiter(); err == nil {
+			t.Errorf("expected error for %q", yamlConfig)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// localRecords holds the static records configured with the `records`
+// directive. Names found here are answered locally and never forwarded.
+type localRecords struct {
+	mu    sync.RWMutex
+	names map[string][]dns.RR // lowercased owner name -> records
+	rr    map[string]int      // round-robin offset per owner name
+}
+
+// parseRecords converts RR strings like "db.corp. 60 IN A 10.1.2.3" into
+// records indexed by owner name.
+func parseRecords(lines []string) (map[string][]dns.RR, error) {
+	names := make(map[string][]dns.RR)
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid record %q: %v", line, err)
+		}
+		if rr == nil {
+			continue
+		}
+		name := strings.ToLower(rr.Header().Name)
+		names[name] = append(names[name], rr)
+	}
+	return names, nil
+}
+
+func newLocalRecords() (*localRecords, error) {
+	names, err := parseRecords(configStrings("records"))
+	if err != nil {
+		return nil, err
+	}
+	return &localRecords{names: names, rr: make(map[string]int)}, nil
+}
+
+// lookup returns a response for req built from static records or nil if
+// the question name is not configured locally.
+func (l *localRecords) lookup(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rrs, ok := l.names[name]
+	if !ok {
+		return nil
+	}
+
+	var answer []dns.RR
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || q.Qtype == dns.TypeANY || (t == dns.TypeCNAME && q.Qtype != dns.TypeCNAME) {
+			answer = append(answer, dns.Copy(rr))
+		}
+	}
+	// rotate answers so clients spread the load among records of the same name
+	if len(answer) > 1 {
+		offset := l.rr[name] % len(answer)
+		answer = append(answer[offset:], answer[:offset]...)
+		l.rr[name] = offset + 1
+	}
+	// follow a local CNAME target when it is also defined locally
+	if len(answer) == 1 {
+		if cname, ok := answer[0].(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+			for _, rr := range l.names[strings.ToLower(cname.Target)] {
+				if rr.Header().Rrtype == q.Qtype {
+					answer = append(answer, dns.Copy(rr))
+				}
+			}
+		}
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.Answer = answer
+	return resp
+}
+
+func (l *localRecords) dump() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, rrs := range l.names {
+		for _, rr := range rrs {
+			configLog.info("record", "rr", rr.String())
+		}
+	}
+}
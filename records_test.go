@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLocalRecordsLookup(t *testing.T) {
+	names, err := parseRecords([]string{
+		"db.corp. 60 IN A 10.1.2.3",
+		"db.corp. 60 IN A 10.1.2.4",
+		"api.corp. CNAME db.corp.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &localRecords{names: names, rr: make(map[string]int)}
+
+	req := new(dns.Msg)
+	req.SetQuestion("DB.corp.", dns.TypeA)
+	first := l.lookup(req)
+	second := l.lookup(req)
+	if len(first.Answer) != 2 || len(second.Answer) != 2 {
+		t.Fatalf("expected 2 answers, got %d and %d", len(first.Answer), len(second.Answer))
+	}
+	if first.Answer[0].String() == second.Answer[0].String() {
+		t.Errorf("answers were not rotated: %v", first.Answer[0])
+	}
+
+	req.SetQuestion("api.corp.", dns.TypeA)
+	if resp := l.lookup(req); len(resp.Answer) != 3 {
+		t.Errorf("expected CNAME plus 2 targets, got %v", resp.Answer)
+	}
+
+	req.SetQuestion("db.corp.", dns.TypeAAAA)
+	if resp := l.lookup(req); resp == nil || len(resp.Answer) != 0 {
+		t.Errorf("expected NODATA for local name, got %v", resp)
+	}
+
+	req.SetQuestion("other.corp.", dns.TypeA)
+	if resp := l.lookup(req); resp != nil {
+		t.Errorf("expected no local answer, got %v", resp)
+	}
+}
+
+func TestParseRecordsError(t *testing.T) {
+	if _, err := parseRecords([]string{"db.corp. IN A not-an-ip"}); err == nil {
+		t.Error("expected error for invalid record")
+	}
+}
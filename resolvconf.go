@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+// resolvConfWatcher reloads the nameservers when the resolv.conf file
+// configured with `nameservers_from` changes (DHCP, VPN, etc).
+type resolvConfWatcher struct {
+	path    string
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+var (
+	wmu          sync.Mutex
+	resolvConfWt *resolvConfWatcher
+)
+
+// resolvConfNameservers returns the nameservers listed in a resolv.conf
+// file, leaving out the addresses lresolver itself listens on to avoid
+// forwarding loops, and the query timeout set in its options.
+func resolvConfNameservers(path string, listeners []*listener) ([]string, time.Duration, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	var list []string
+	for _, server := range conf.Servers {
+		addr := net.JoinHostPort(server, conf.Port)
+		if isListening(addr, listeners) {
+			configLog.info("skipping nameserver: lresolver listens on it", "nameserver", addr, "file", path)
+			continue
+		}
+		list = append(list, addr)
+	}
+	if len(conf.Search) > 0 {
+		// clients expand search domains before querying lresolver
+		configLog.info("ignoring search domains", "file", path, "search", conf.Search)
+	}
+	return list, time.Duration(conf.Timeout) * time.Second, nil
+}
+
+// isListening reports whether any of the listeners uses addr.
+func isListening(addr string, listeners []*listener) bool {
+	for _, l := range listeners {
+		if isOwnAddress(addr, l.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnAddress reports whether addr is the bind address, or a local
+// address on the same port when binding to all interfaces.
+func isOwnAddress(addr, bind string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	bhost, bport, err := net.SplitHostPort(bind)
+	if err != nil || port != bport {
+		return false
+	}
+	ip, bip := net.ParseIP(host), net.ParseIP(bhost)
+	if ip == nil {
+		return false
+	}
+	if bip != nil && !bip.IsUnspecified() {
+		return ip.Equal(bip)
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchResolvConf starts watching path, replacing the current watcher.
+// An empty path just stops watching.
+func watchResolvConf(path string) {
+	wmu.Lock()
+	defer wmu.Unlock()
+	if resolvConfWt != nil {
+		if resolvConfWt.path == path {
+			return
+		}
+		close(resolvConfWt.done)
+		resolvConfWt.watcher.Close()
+		resolvConfWt = nil
+	}
+	if path == "" {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		configLog.error("error watching", "file", path, "error", err)
+		return
+	}
+	// watch the directory to pick up files replaced by rename
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		configLog.error("error watching", "file", path, "error", err)
+		watcher.Close()
+		return
+	}
+	w := &resolvConfWatcher{path: path, watcher: watcher, done: make(chan struct{})}
+	resolvConfWt = w
+	go w.run()
+}
+
+func (w *resolvConfWatcher) run() {
+	name := filepath.Clean(w.path)
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == name && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				configLog.info("file changed, updating nameservers", "file", w.path)
+				reloadNameservers()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			configLog.error("error watching", "file", w.path, "error", err)
+		}
+	}
+}
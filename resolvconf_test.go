@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResolvConfNameservers(t *testing.T) {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("search corp.example\nnameserver 127.0.0.1\nnameserver 10.0.0.1\nnameserver 10.0.0.2\noptions timeout:3\n")
+	f.Close()
+
+	list, timeout, err := resolvConfNameservers(f.Name(), []*listener{{Address: "127.0.0.1:53"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != "10.0.0.1:53" || list[1] != "10.0.0.2:53" {
+		t.Errorf("unexpected nameservers %v", list)
+	}
+	if timeout != 3*time.Second {
+		t.Errorf("timeout = %v, want 3s", timeout)
+	}
+}
+
+func TestIsOwnAddress(t *testing.T) {
+	tests := []struct {
+		addr, bind string
+		own        bool
+	}{
+		{"127.0.0.1:53", "127.0.0.1:53", true},
+		{"127.0.0.1:53", "127.0.0.1:5300", false},
+		{"127.0.0.1:53", "0.0.0.0:53", true},
+		{"10.0.0.1:53", "127.0.0.1:53", false},
+		{"[::1]:53", "[::]:53", true},
+	}
+	for _, test := range tests {
+		if own := isOwnAddress(test.addr, test.bind); own != test.own {
+			t.Errorf("isOwnAddress(%s, %s) = %v, want %v", test.addr, test.bind, own, test.own)
+		}
+	}
+}
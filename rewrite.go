@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// rewriteRule applies to a domain and all of its subdomains. A rule can
+// rewrite the question name before forwarding (To), flatten CNAME chains
+// into direct answers (Flatten) and drop RR types from responses (Filter).
+type rewriteRule struct {
+	Name    string   `mapstructure:"name"`
+	To      string   `mapstructure:"to"`
+	Flatten bool     `mapstructure:"flatten"`
+	Filter  []string `mapstructure:"filter"`
+
+	filter map[uint16]bool
+}
+
+// parseRewrites reads the rules configured with the `rewrites` directive.
+func parseRewrites() ([]*rewriteRule, error) {
+	var rules []*rewriteRule
+	if err := viper.UnmarshalKey("rewrites", &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if _, ok := dns.IsDomainName(rule.Name); !ok || rule.Name == "" {
+			return nil, fmt.Errorf("invalid rewrite name %q", rule.Name)
+		}
+		rule.Name = dns.Fqdn(strings.ToLower(rule.Name))
+		if rule.To != "" {
+			if _, ok := dns.IsDomainName(rule.To); !ok {
+				return nil, fmt.Errorf("invalid rewrite target %q", rule.To)
+			}
+			rule.To = dns.Fqdn(strings.ToLower(rule.To))
+		}
+		rule.filter = make(map[uint16]bool)
+		for _, name := range rule.Filter {
+			rrtype, ok := dns.StringToType[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("invalid rewrite filter type %q", name)
+			}
+			rule.filter[rrtype] = true
+		}
+	}
+	return rules, nil
+}
+
+func dumpRewrites(rules []*rewriteRule) {
+	for _, rule := range rules {
+		configLog.info("rewrite", "name", rule.Name, "to", rule.To, "flatten", rule.Flatten, "filter", rule.Filter)
+	}
+}
+
+// findRewrite returns the first rule matching name, or nil.
+func findRewrite(rules []*rewriteRule, name string) *rewriteRule {
+	for _, rule := range rules {
+		if dns.IsSubDomain(rule.Name, strings.ToLower(name)) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// rewriteRequest returns the request to send upstream. When the rule has a
+// target the question name suffix is replaced, otherwise req is returned.
+func (rule *rewriteRule) rewriteRequest(req *dns.Msg) *dns.Msg {
+	if rule.To == "" {
+		return req
+	}
+	up := req.Copy()
+	name := req.Question[0].Name
+	up.Question[0].Name = name[:len(name)-len(rule.Name)] + rule.To
+	upstreamLog.debug("rewriting", "name", name, "to", up.Question[0].Name)
+	return up
+}
+
+// rewriteResponse turns the upstream response to up into a response to
+// req, restoring the original question name and applying flattening and
+// filtering. The upstream response is not modified.
+func (rule *rewriteRule) rewriteResponse(req, up, in *dns.Msg) *dns.Msg {
+	out := in.Copy()
+	out.Question = req.Question
+
+	qname := req.Question[0].Name
+	upname := up.Question[0].Name
+	if upname != qname {
+		for _, section := range [][]dns.RR{out.Answer, out.Ns, out.Extra} {
+			for _, rr := range section {
+				if strings.EqualFold(rr.Header().Name, upname) {
+					rr.Header().Name = qname
+				}
+			}
+		}
+	}
+	if rule.Flatten {
+		out.Answer = flattenCNAME(qname, req.Question[0].Qtype, out.Answer)
+	}
+	if len(rule.filter) > 0 {
+		out.Answer = filterRRs(out.Answer, rule.filter)
+		out.Extra = filterRRs(out.Extra, rule.filter)
+	}
+	return out
+}
+
+// flattenCNAME replaces a CNAME chain starting at qname with the records
+// of the final target, owned by qname and using the lowest TTL seen along
+// the chain. The answer is returned unchanged if the chain is incomplete.
+func flattenCNAME(qname string, qtype uint16, answer []dns.RR) []dns.RR {
+	if qtype == dns.TypeCNAME {
+		return answer
+	}
+	target := qname
+	ttl := ^uint32(0)
+	seen := make(map[string]bool)
+	for !seen[strings.ToLower(target)] {
+		seen[strings.ToLower(target)] = true
+		var next string
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, target) {
+				next = cname.Target
+				if cname.Hdr.Ttl < ttl {
+					ttl = cname.Hdr.Ttl
+				}
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if target == qname {
+		return answer
+	}
+
+	var flat []dns.RR
+	for _, rr := range answer {
+		hdr := rr.Header()
+		if hdr.Rrtype == qtype && strings.EqualFold(hdr.Name, target) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = qname
+			if rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+			flat = append(flat, rr)
+		}
+	}
+	if len(flat) == 0 {
+		return answer
+	}
+	return flat
+}
+
+func filterRRs(rrs []dns.RR, filter map[uint16]bool) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if !filter[rr.Header().Rrtype] {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
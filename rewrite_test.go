@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestRewriteNameAndFilter(t *testing.T) {
+	rule := &rewriteRule{Name: "old-domain.com.", To: "new-domain.com.", filter: map[uint16]bool{dns.TypeAAAA: true}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("svc.old-domain.com.", dns.TypeA)
+	up := rule.rewriteRequest(req)
+	if up.Question[0].Name != "svc.new-domain.com." {
+		t.Fatalf("question not rewritten: %v", up.Question[0].Name)
+	}
+
+	in := new(dns.Msg)
+	in.SetReply(up)
+	in.Answer = []dns.RR{mustRR(t, "svc.new-domain.com. 60 IN A 10.0.0.1")}
+	in.Extra = []dns.RR{mustRR(t, "svc.new-domain.com. 60 IN AAAA ::1")}
+	out := rule.rewriteResponse(req, up, in)
+	if out.Question[0].Name != "svc.old-domain.com." || out.Answer[0].Header().Name != "svc.old-domain.com." {
+		t.Errorf("name not restored: %v", out)
+	}
+	if len(out.Extra) != 0 {
+		t.Errorf("AAAA not filtered: %v", out.Extra)
+	}
+	if in.Answer[0].Header().Name != "svc.new-domain.com." {
+		t.Errorf("upstream response was modified")
+	}
+}
+
+func TestFlattenCNAME(t *testing.T) {
+	answer := []dns.RR{
+		mustRR(t, "www.example.com. 300 IN CNAME cdn.example.net."),
+		mustRR(t, "cdn.example.net. 30 IN CNAME edge.example.org."),
+		mustRR(t, "edge.example.org. 60 IN A 10.0.0.1"),
+		mustRR(t, "edge.example.org. 60 IN A 10.0.0.2"),
+	}
+	flat := flattenCNAME("www.example.com.", dns.TypeA, answer)
+	if len(flat) != 2 {
+		t.Fatalf("expected 2 records, got %v", flat)
+	}
+	for _, rr := range flat {
+		if rr.Header().Name != "www.example.com." || rr.Header().Ttl != 30 {
+			t.Errorf("unexpected flattened record %v", rr)
+		}
+	}
+
+	incomplete := answer[:2]
+	if got := flattenCNAME("www.example.com.", dns.TypeA, incomplete); len(got) != 2 {
+		t.Errorf("incomplete chain should be kept, got %v", got)
+	}
+}
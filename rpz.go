@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// RPZ policy actions
+const (
+	rpzNXDomain  = "NXDOMAIN"
+	rpzNoData    = "NODATA"
+	rpzPassthru  = "PASSTHRU"
+	rpzDrop      = "DROP"
+	rpzTCPOnly   = "TCP-ONLY"
+	rpzLocalData = "LOCAL-DATA"
+)
+
+// rpzZone is a Response Policy Zone loaded from a zone file or transferred
+// from a primary server. Only QNAME triggers are supported.
+type rpzZone struct {
+	Zone    string `mapstructure:"zone"`
+	File    string `mapstructure:"file"`
+	Primary string `mapstructure:"primary"`
+	Refresh int64  `mapstructure:"refresh"` // seconds between transfers, default 3600
+
+	mu    sync.RWMutex
+	rules map[string][]dns.RR // lowercased trigger name -> policy records
+	stop  chan struct{}
+}
+
+// rpzHit is the policy rule matched by a query.
+type rpzHit struct {
+	zone    string
+	trigger string
+	action  string
+	rrs     []dns.RR
+}
+
+// newPolicies loads the zones configured with the `rpz` directive.
+// Transfers are refreshed only after startPolicies is called.
+func newPolicies() ([]*rpzZone, error) {
+	var zones []*rpzZone
+	if err := viper.UnmarshalKey("rpz", &zones); err != nil {
+		return nil, err
+	}
+	for _, z := range zones {
+		if _, ok := dns.IsDomainName(z.Zone); !ok || z.Zone == "" {
+			return nil, fmt.Errorf("invalid rpz zone name %q", z.Zone)
+		}
+		if (z.File == "") == (z.Primary == "") {
+			return nil, fmt.Errorf("rpz zone %s: exactly one of file or primary is required", z.Zone)
+		}
+		z.Zone = dns.Fqdn(strings.ToLower(z.Zone))
+		if z.Primary != "" {
+			primary, err := fixDNSAddress(z.Primary)
+			if err != nil {
+				return nil, fmt.Errorf("rpz zone %s: %v", z.Zone, err)
+			}
+			z.Primary = primary
+		}
+		if err := z.load(); err != nil {
+			return nil, fmt.Errorf("rpz zone %s: %v", z.Zone, err)
+		}
+		z.stop = make(chan struct{})
+	}
+	return zones, nil
+}
+
+// startPolicies starts refreshing the zones transferred from a primary.
+func startPolicies(zones []*rpzZone) {
+	for _, z := range zones {
+		if z.Primary != "" {
+			go z.refresh()
+		}
+	}
+}
+
+func stopPolicies(zones []*rpzZone) {
+	for _, z := range zones {
+		close(z.stop)
+	}
+}
+
+// load reads the zone and replaces its rules.
+func (z *rpzZone) load() error {
+	var (
+		rrs []dns.RR
+		err error
+	)
+	if z.File != "" {
+		rrs, err = readZoneFile(z.File, z.Zone)
+	} else {
+		rrs, err = transferZone(z.Zone, z.Primary)
+	}
+	if err != nil {
+		return err
+	}
+
+	rules := make(map[string][]dns.RR)
+	skipped := 0
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == z.Zone || !dns.IsSubDomain(z.Zone, owner) {
+			// apex SOA/NS records and out of zone data
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, z.Zone)
+		if isUnsupportedTrigger(trigger) {
+			skipped++
+			continue
+		}
+		if trigger == "" || trigger == "." {
+			continue
+		}
+		rules[trigger] = append(rules[trigger], rr)
+	}
+	if skipped > 0 {
+		configLog.info("rpz: skipped rules with unsupported triggers", "zone", z.Zone, "rules", skipped)
+	}
+	configLog.info("rpz: zone loaded", "zone", z.Zone, "rules", len(rules))
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.rules = rules
+	return nil
+}
+
+// refresh transfers the zone again every Refresh seconds until the zone
+// is stopped by a reload.
+func (z *rpzZone) refresh() {
+	interval := z.Refresh
+	if interval <= 0 {
+		interval = 3600
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-z.stop:
+			return
+		case <-ticker.C:
+			if err := z.load(); err != nil {
+				configLog.error("rpz: error refreshing zone, keeping current rules", "zone", z.Zone, "error", err)
+			}
+		}
+	}
+}
+
+// isUnsupportedTrigger reports whether the trigger is not a QNAME trigger
+// (IP, NSDNAME, NSIP or client IP triggers).
+func isUnsupportedTrigger(trigger string) bool {
+	labels := dns.SplitDomainName(trigger)
+	if len(labels) == 0 {
+		return false
+	}
+	switch labels[len(labels)-1] {
+	case "rpz-ip", "rpz-nsdname", "rpz-nsip", "rpz-client-ip":
+		return true
+	}
+	return false
+}
+
+func readZoneFile(file, origin string) ([]dns.RR, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rrs []dns.RR
+	for token := range dns.ParseZone(f, origin, file) {
+		if token.Error != nil {
+			return nil, token.Error
+		}
+		rrs = append(rrs, token.RR)
+	}
+	return rrs, nil
+}
+
+func transferZone(zone, primary string) ([]dns.RR, error) {
+	req := new(dns.Msg)
+	req.SetAxfr(zone)
+	t := new(dns.Transfer)
+	env, err := t.In(req, primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+// match returns the rule for qname: an exact trigger wins over the
+// closest wildcard trigger.
+func (z *rpzZone) match(qname string) *rpzHit {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	name := strings.ToLower(dns.Fqdn(qname))
+	if rrs, ok := z.rules[name]; ok {
+		return newPolicyHit(z.Zone, name, rrs)
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		trigger := "*." + strings.Join(labels[i:], ".") + "."
+		if rrs, ok := z.rules[trigger]; ok {
+			return newPolicyHit(z.Zone, trigger, rrs)
+		}
+	}
+	return nil
+}
+
+func newPolicyHit(zone, trigger string, rrs []dns.RR) *rpzHit {
+	hit := &rpzHit{zone: zone, trigger: trigger, action: rpzLocalData, rrs: rrs}
+	if len(rrs) == 1 {
+		if cname, ok := rrs[0].(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				hit.action = rpzNXDomain
+			case "*.":
+				hit.action = rpzNoData
+			case "rpz-passthru.":
+				hit.action = rpzPassthru
+			case "rpz-drop.":
+				hit.action = rpzDrop
+			case "rpz-tcp-only.":
+				hit.action = rpzTCPOnly
+			}
+		}
+	}
+	return hit
+}
+
+// lookupPolicy checks qname against every zone in configuration order and
+// returns the first hit, or nil.
+func lookupPolicy(zones []*rpzZone, qname string) *rpzHit {
+	for _, z := range zones {
+		if hit := z.match(qname); hit != nil {
+			return hit
+		}
+	}
+	return nil
+}
+
+// respond builds the response to req for the policy action. A local data
+// CNAME is followed upstream so clients get the rewritten answer.
+func (h *rpzHit) respond(servers *nameservers, req *dns.Msg, qi *queryInfo) *dns.Msg {
+	q := req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	switch h.action {
+	case rpzNXDomain:
+		resp.Rcode = dns.RcodeNameError
+		return resp
+	case rpzNoData:
+		return resp
+	case rpzTCPOnly:
+		if qi.net == "udp" {
+			resp.Truncated = true
+			return resp
+		}
+		in, err := servers.forward(req, qi)
+		if err != nil {
+			resp.Rcode = dns.RcodeServerFailure
+			return resp
+		}
+		return in
+	}
+
+	for _, rr := range h.rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		if cname, ok := rr.(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+			// "*.garden." rewrites to the query name under garden.
+			if strings.HasPrefix(cname.Target, "*.") {
+				cname.Target = q.Name + cname.Target[2:]
+			}
+			resp.Answer = append(resp.Answer, cname)
+			target := new(dns.Msg)
+			target.SetQuestion(cname.Target, q.Qtype)
+			if in, err := servers.forward(target, qi); err == nil {
+				resp.Answer = append(resp.Answer, in.Answer...)
+				resp.Rcode = in.Rcode
+			}
+			return resp
+		}
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const rpzZoneData = `
+$TTL 300
+@                    SOA localhost. root.localhost. 1 3600 600 86400 60
+@                    NS  localhost.
+bad.example          CNAME .
+*.bad.example        CNAME .
+empty.example        CNAME *.
+ok.bad.example       CNAME rpz-passthru.
+drop.example         CNAME rpz-drop.
+local.example        A   10.0.0.1
+32.1.0.0.10.rpz-ip   CNAME .
+`
+
+// startAXFRStub serves the RPZ zone data over AXFR on a local TCP port.
+func startAXFRStub(t *testing.T, zone string, rrs []dns.RR) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(zone, func(w dns.ResponseWriter, req *dns.Msg) {
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: append(append([]dns.RR{}, rrs...), rrs[0])}
+		close(ch)
+		tr := new(dns.Transfer)
+		tr.Out(w, req, ch)
+		w.Close()
+	})
+	server := &dns.Server{Listener: l, Handler: mux}
+	go server.ActivateAndServe()
+	return l.Addr().String(), func() { server.Shutdown() }
+}
+
+func TestRPZTransferAndMatch(t *testing.T) {
+	zone := "rpz.test."
+	var rrs []dns.RR
+	for token := range dns.ParseZone(strings.NewReader(rpzZoneData), zone, "") {
+		if token.Error != nil {
+			t.Fatal(token.Error)
+		}
+		rrs = append(rrs, token.RR)
+	}
+	addr, stop := startAXFRStub(t, zone, rrs)
+	defer stop()
+
+	z := &rpzZone{Zone: zone, Primary: addr}
+	if err := z.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qname  string
+		action string
+	}{
+		{"bad.example.", rpzNXDomain},
+		{"www.bad.example.", rpzNXDomain},
+		{"ok.bad.example.", rpzPassthru},
+		{"empty.example.", rpzNoData},
+		{"drop.example.", rpzDrop},
+		{"local.example.", rpzLocalData},
+	}
+	for _, test := range tests {
+		hit := z.match(test.qname)
+		if hit == nil || hit.action != test.action {
+			t.Errorf("match(%s) = %v, want %s", test.qname, hit, test.action)
+		}
+	}
+	if hit := z.match("good.example."); hit != nil {
+		t.Errorf("unexpected hit %v", hit)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("local.example.", dns.TypeA)
+	resp := z.match("local.example.").respond(nil, req, &queryInfo{net: "udp"})
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "local.example." {
+		t.Errorf("unexpected local data response %v", resp)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// value kinds used by the configuration schema
+const (
+	kindBool    = "bool"
+	kindInt     = "int"
+	kindString  = "string"
+	kindStrings = "list of strings"
+	kindList    = "list of maps"
+)
+
+// configKey describes a configuration directive. For kindList, fields
+// lists the directives allowed in each entry.
+type configKey struct {
+	kind   string
+	fields map[string]configKey
+	check  func(value interface{}) error
+}
+
+var configSchema = map[string]configKey{
+	"bind":          {kind: kindStrings, check: checkAddresses},
+	"tcp":           {kind: kindBool},
+	"tls_bind":      {kind: kindStrings},
+	"tls_cert":      {kind: kindString},
+	"tls_key":       {kind: kindString},
+	"tls_client_ca": {kind: kindString},
+	"listeners": {kind: kindList, fields: map[string]configKey{
+		"address":    {kind: kindString, check: checkAddress},
+		"transports": {kind: kindStrings},
+		"allow":      {kind: kindStrings},
+		"deny":       {kind: kindStrings},
+		"acl_action": {kind: kindString},
+		"cert":       {kind: kindString},
+		"key":        {kind: kindString},
+		"client_ca":  {kind: kindString},
+		"json":       {kind: kindBool},
+	}},
+	"admin_bind": {kind: kindString, check: checkAdminAddress},
+	"acl": {kind: kindList, fields: map[string]configKey{
+		"networks": {kind: kindStrings},
+		"domains":  {kind: kindStrings},
+		"qtypes":   {kind: kindStrings},
+	}},
+	"acl_action":       {kind: kindString},
+	"cache":            {kind: kindBool},
+	"negative_cache":   {kind: kindBool},
+	"max_cache_ttl":    {kind: kindInt, check: checkNonNegative},
+	"nameservers":      {kind: kindStrings, check: checkAddresses},
+	"nameservers_from": {kind: kindString},
+	"records":          {kind: kindStrings},
+	"blocklists":       {kind: kindStrings},
+	"allowlist":        {kind: kindStrings},
+	"block_action":     {kind: kindString},
+	"block_refresh":    {kind: kindInt, check: checkNonNegative},
+	"rewrites": {kind: kindList, fields: map[string]configKey{
+		"name":    {kind: kindString},
+		"to":      {kind: kindString},
+		"flatten": {kind: kindBool},
+		"filter":  {kind: kindStrings},
+	}},
+	"rpz": {kind: kindList, fields: map[string]configKey{
+		"zone":    {kind: kindString},
+		"file":    {kind: kindString},
+		"primary": {kind: kindString, check: checkAddress},
+		"refresh": {kind: kindInt, check: checkNonNegative},
+	}},
+	"dns64":         {kind: kindBool},
+	"dns64_prefix":  {kind: kindString},
+	"dns64_exclude": {kind: kindStrings},
+
+	"rate_limit":             {kind: kindInt, check: checkNonNegative},
+	"rate_limit_burst":       {kind: kindInt, check: checkNonNegative},
+	"rate_limit_action":      {kind: kindString},
+	"rate_limit_ipv4_prefix": {kind: kindInt},
+	"rate_limit_ipv6_prefix": {kind: kindInt},
+	"rate_limit_exempt":      {kind: kindStrings},
+	"rrl":                    {kind: kindInt, check: checkNonNegative},
+	"rrl_burst":              {kind: kindInt, check: checkNonNegative},
+	"rrl_action":             {kind: kindString},
+
+	"query_log":             {kind: kindString},
+	"query_log_max_size":    {kind: kindInt, check: checkNonNegative},
+	"query_log_max_backups": {kind: kindInt, check: checkNonNegative},
+	"query_log_sample":      {kind: kindInt},
+	"query_log_exclude":     {kind: kindStrings},
+
+	"dnstap":            {kind: kindString},
+	"dnstap_identity":   {kind: kindString},
+	"dnstap_queue_size": {kind: kindInt},
+
+	"tracing":         {kind: kindString},
+	"tracing_service": {kind: kindString},
+	"tracing_sample":  {kind: kindInt},
+
+	"slow_query_log": {kind: kindBool},
+	"slow_query_ms":  {kind: kindInt, check: checkNonNegative},
+
+	"health_canary": {kind: kindString},
+
+	"dnssec":        {kind: kindBool},
+	"trust_anchors": {kind: kindStrings},
+
+	"log_output": {kind: kindString},
+	"log_format": {kind: kindString},
+	"log_level":  {kind: kindString},
+	"log_levels": {kind: kindStrings},
+
+	"top_size":   {kind: kindInt, check: checkNonNegative},
+	"top_window": {kind: kindInt},
+
+	"config_store":           {kind: kindString},
+	"config_store_endpoints": {kind: kindStrings},
+	"config_store_prefix":    {kind: kindString},
+}
+
+// validateConfig checks every directive read by viper against the schema
+// and returns all problems found.
+func validateConfig() []error {
+	var errs []error
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		schema, ok := configSchema[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown directive %q", key))
+			continue
+		}
+		for _, err := range schema.validate(viper.Get(key)) {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	return errs
+}
+
+func (schema configKey) validate(value interface{}) []error {
+	if value == nil {
+		return nil
+	}
+	if err := checkKind(schema.kind, value); err != nil {
+		return []error{err}
+	}
+	if schema.kind == kindList {
+		return schema.validateEntries(value)
+	}
+	if schema.check != nil {
+		if err := schema.check(value); err != nil {
+			return []error{err}
+		}
+	}
+	return nil
+}
+
+func (schema configKey) validateEntries(value interface{}) []error {
+	var errs []error
+	for i, item := range value.([]interface{}) {
+		entry, err := cast.ToStringMapE(item)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("entry %d: expected a map", i+1))
+			continue
+		}
+		names := make([]string, 0, len(entry))
+		for name := range entry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field, ok := schema.fields[strings.ToLower(name)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("entry %d: unknown directive %q", i+1, name))
+				continue
+			}
+			for _, err := range field.validate(entry[name]) {
+				errs = append(errs, fmt.Errorf("entry %d: %s: %v", i+1, name, err))
+			}
+		}
+	}
+	return errs
+}
+
+func checkKind(kind string, value interface{}) error {
+	var err error
+	switch kind {
+	case kindBool:
+		_, err = cast.ToBoolE(value)
+	case kindInt:
+		_, err = toInt64(value)
+	case kindString:
+		switch value.(type) {
+		case string, int, int64, float64:
+		default:
+			err = fmt.Errorf("unexpected %T", value)
+		}
+	case kindStrings:
+		_, err = toStrings(value)
+	case kindList:
+		if _, ok := value.([]interface{}); !ok {
+			err = fmt.Errorf("unexpected %T", value)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("expected %s", kind)
+	}
+	return nil
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected %T", value)
+}
+
+func toStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []string:
+		return v, nil
+	case string:
+		// lists from flags and environment variables are comma separated
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case string, int, int64, float64:
+				list[i] = cast.ToString(item)
+			default:
+				return nil, fmt.Errorf("unexpected %T", item)
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unexpected %T", value)
+}
+
+// configStrings returns a list directive, splitting comma separated values
+// set by flags or environment variables.
+func configStrings(key string) []string {
+	list, _ := toStrings(viper.Get(key))
+	return list
+}
+
+func checkNonNegative(value interface{}) error {
+	if v, _ := toInt64(value); v < 0 {
+		return fmt.Errorf("must not be negative, got %d", v)
+	}
+	return nil
+}
+
+func checkAddress(value interface{}) error {
+	_, err := fixDNSAddress(cast.ToString(value))
+	return err
+}
+
+func checkAdminAddress(value interface{}) error {
+	_, err := fixAddress(cast.ToString(value), adminPort)
+	return err
+}
+
+func checkAddresses(value interface{}) error {
+	list, _ := toStrings(value)
+	for _, addr := range list {
+		if _, err := fixDNSAddress(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
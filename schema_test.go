@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestValidateConfig(t *testing.T) {
+	readTestConfig(t, `
+bind: "[::1]:5300"
+negative_cahce: false
+max_cache_ttl: -1
+tcp: maybe
+nameservers:
+- 8.8.8.8
+- 10.0.0.1:70000
+rpz:
+- zone: rpz.example.
+  file: /dev/null
+  primry: 10.0.0.1
+`)
+	errs := validateConfig()
+	want := []string{
+		`max_cache_ttl: must not be negative, got -1`,
+		`nameservers: invalid address "10.0.0.1:70000": bad port "70000"`,
+		`unknown directive "negative_cahce"`,
+		`rpz: entry 1: unknown directive "primry"`,
+		`tcp: expected bool`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != want[i] {
+			t.Errorf("error %d = %q, want %q", i, err, want[i])
+		}
+	}
+}
+
+func TestValidateAdminBind(t *testing.T) {
+	readTestConfig(t, "admin_bind: bad host\n")
+	errs := validateConfig()
+	want := `admin_bind: invalid address "bad host:9153": bad host "bad host"`
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("errors = %v, want %q", errs, want)
+	}
+	readTestConfig(t, "admin_bind: '::1'\n")
+	if errs := validateConfig(); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestFixDNSAddress(t *testing.T) {
+	tests := map[string]string{
+		"8.8.8.8":        "8.8.8.8:53",
+		"8.8.8.8:5353":   "8.8.8.8:5353",
+		"ns.example.com": "ns.example.com:53",
+		":53":            ":53",
+		"::1":            "[::1]:53",
+		"[::1]":          "[::1]:53",
+		"[::1]:5353":     "[::1]:5353",
+		"2001:db8::1":    "[2001:db8::1]:53",
+	}
+	for addr, want := range tests {
+		if got, err := fixDNSAddress(addr); err != nil || got != want {
+			t.Errorf("fixDNSAddress(%q) = %q, %v; want %q", addr, got, err, want)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8:0", "8.8.8.8:dns", "bad host", "[::1]:0", "[::1"} {
+		if _, err := fixDNSAddress(addr); err == nil {
+			t.Errorf("expected error for %q", addr)
+		}
+	}
+}
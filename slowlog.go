@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// slowLog logs, as warnings, the queries that took longer than
+// `slow_query_ms`, needed the fallback to all nameservers or failed, with
+// the timeline of the queries sent to the nameservers (`slow_query_log`).
+type slowLog struct {
+	enabled   bool
+	threshold time.Duration
+}
+
+func newSlowLog() *slowLog {
+	return &slowLog{
+		enabled:   viper.GetBool("slow_query_log"),
+		threshold: time.Duration(viper.GetInt("slow_query_ms")) * time.Millisecond,
+	}
+}
+
+func (s *slowLog) log(q *queryInfo) {
+	if s.enabled && s.slow(q, time.Since(q.start)) {
+		upstreamLog.warn("slow query", slowQueryFields(q)...)
+	}
+}
+
+// slow reports whether q, which took latency, is logged.
+func (s *slowLog) slow(q *queryInfo, latency time.Duration) bool {
+	q.mu.Lock()
+	broadcast := q.broadcast
+	q.mu.Unlock()
+	return broadcast || q.source == sourceFailed || (s.threshold > 0 && latency >= s.threshold)
+}
+
+// slowQueryFields describes q and its upstream queries, in the order they
+// were sent, with their start relative to q.
+func slowQueryFields(q *queryInfo) []interface{} {
+	var name, qtype, client string
+	if len(q.req.Question) > 0 {
+		name, qtype = q.req.Question[0].Name, typeString(q.req.Question[0].Qtype)
+	}
+	if q.client != nil {
+		client = q.client.String()
+	}
+	rcode := "dropped"
+	if q.resp != nil {
+		rcode = rcodeString(q.resp.Rcode)
+	}
+
+	q.mu.Lock()
+	attempts := append([]upstreamAttempt(nil), q.attempts...)
+	upstream, broadcast := q.upstream, q.broadcast
+	q.mu.Unlock()
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].start.Before(attempts[j].start) })
+	timeline := make([]string, len(attempts))
+	for i, a := range attempts {
+		t := fmt.Sprintf("%s at +%s took %s: ", a.server, formatMS(a.start.Sub(q.start)), formatMS(a.rtt))
+		if a.err != nil {
+			t += "error " + a.err.Error()
+		} else {
+			t += rcodeString(a.rcode)
+		}
+		if a.server == upstream && a.err == nil {
+			t += " (used)"
+		}
+		timeline[i] = t
+	}
+	return []interface{}{
+		"name", name, "type", qtype, "client", client, "transport", q.transport,
+		"latency", formatMS(time.Since(q.start)), "rcode", rcode, "source", q.source,
+		"fallback", broadcast, "upstreams", strings.Join(timeline, "; "),
+	}
+}
+
+func formatMS(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSlowLog(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("slow.example.", dns.TypeA)
+	start := time.Now().Add(-2 * time.Second)
+	q := &queryInfo{
+		start:     start,
+		req:       req,
+		client:    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353},
+		transport: "udp",
+		source:    sourceUpstream,
+		resp:      new(dns.Msg).SetReply(req),
+	}
+	s := &slowLog{enabled: true, threshold: 500 * time.Millisecond}
+	if s.slow(q, 100*time.Millisecond) {
+		t.Error("fast query is slow")
+	}
+	if !s.slow(q, time.Second) {
+		t.Error("slow query not logged")
+	}
+
+	// the second attempt is added first, as in broadcastResolve
+	q.addAttempt("10.0.0.2:53", start.Add(1500*time.Millisecond), 12*time.Millisecond, q.resp, nil)
+	q.addAttempt("10.0.0.1:53", start, 0, nil, errors.New("i/o timeout"))
+	q.setBroadcast()
+	q.setUpstream("10.0.0.2:53")
+	if !(&slowLog{enabled: true}).slow(q, 0) {
+		t.Error("broadcast query not logged")
+	}
+	fields := make(map[string]interface{})
+	kv := slowQueryFields(q)
+	for i := 0; i < len(kv); i += 2 {
+		fields[kv[i].(string)] = kv[i+1]
+	}
+	if fields["name"] != "slow.example." || fields["client"] != "192.0.2.1:5353" || fields["rcode"] != "NOERROR" ||
+		fields["source"] != "upstream" || fields["fallback"] != true {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	upstreams := strings.Split(fields["upstreams"].(string), "; ")
+	if len(upstreams) != 2 {
+		t.Fatalf("unexpected upstreams %q", upstreams)
+	}
+	if !strings.HasPrefix(upstreams[0], "10.0.0.1:53 at +0.0ms took ") || !strings.HasSuffix(upstreams[0], ": error i/o timeout") {
+		t.Errorf("unexpected first attempt %q", upstreams[0])
+	}
+	if want := "10.0.0.2:53 at +1500.0ms took 12.0ms: NOERROR (used)"; upstreams[1] != want {
+		t.Errorf("second attempt = %q, want %q", upstreams[1], want)
+	}
+}
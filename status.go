@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+const (
+	// a nameserver is down after this many consecutive failed queries
+	upstreamDownAfter = 3
+	// weight of the last round trip time in the average
+	rttWeight = 0.2
+)
+
+// upstreamStat is the recent state of a nameserver.
+type upstreamStat struct {
+	queries     uint64
+	errors      uint64
+	timeouts    uint64
+	avgRTT      time.Duration // moving average
+	failures    int           // consecutive
+	lastError   string
+	lastSuccess time.Time
+}
+
+func (s *upstreamStat) health() string {
+	switch {
+	case s == nil || s.queries == 0:
+		return "unknown"
+	case s.failures >= upstreamDownAfter, s.lastSuccess.IsZero():
+		return "down"
+	}
+	return "up"
+}
+
+var (
+	upstreamMu    sync.Mutex
+	upstreamStats = make(map[string]*upstreamStat)
+)
+
+// recordUpstream updates the state of nameserver after a query.
+func recordUpstream(nameserver string, rtt time.Duration, err error, timeout bool) {
+	upstreamMu.Lock()
+	defer upstreamMu.Unlock()
+	s := upstreamStats[nameserver]
+	if s == nil {
+		s = &upstreamStat{}
+		upstreamStats[nameserver] = s
+	}
+	s.queries++
+	if err != nil {
+		if timeout {
+			s.timeouts++
+		} else {
+			s.errors++
+		}
+		s.failures++
+		s.lastError = err.Error()
+		return
+	}
+	s.failures = 0
+	s.lastSuccess = time.Now()
+	if s.avgRTT == 0 {
+		s.avgRTT = rtt
+	} else {
+		s.avgRTT = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(s.avgRTT))
+	}
+}
+
+// pruneUpstreamStats forgets the nameservers not in slist, after a reload
+// changed them, along with their metrics.
+func pruneUpstreamStats(slist []string) {
+	keep := make(map[string]bool, len(slist))
+	for _, server := range slist {
+		keep[server] = true
+	}
+	upstreamMu.Lock()
+	defer upstreamMu.Unlock()
+	for server := range upstreamStats {
+		if !keep[server] {
+			delete(upstreamStats, server)
+			upstreamQueries.delete(server)
+			upstreamErrors.delete(server)
+			upstreamTimeouts.delete(server)
+			upstreamRTT.delete(server)
+		}
+	}
+}
+
+// statusReport is the runtime status shown on SIGUSR2 and /status.
+type statusReport struct {
+	Version         string                 `json:"version"`
+	Started         time.Time              `json:"started"`
+	Uptime          string                 `json:"uptime"`
+	QueriesInFlight int64                  `json:"queries_in_flight"`
+	Upstreams       []upstreamStatus       `json:"upstreams"`
+	NextUpstream    string                 `json:"next_upstream"`
+	Cache           cacheStatus            `json:"cache"`
+	Top             map[string][]topEntry  `json:"top"`
+	Config          map[string]interface{} `json:"config"`
+}
+
+type upstreamStatus struct {
+	Server      string     `json:"server"`
+	Health      string     `json:"health"`
+	Queries     uint64     `json:"queries"`
+	Errors      uint64     `json:"errors"`
+	Timeouts    uint64     `json:"timeouts"`
+	AvgRTTMS    float64    `json:"avg_rtt_ms"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+type cacheStatus struct {
+	Enabled  bool    `json:"enabled"`
+	Entries  int     `json:"entries"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+func (cfg *runtimeConfig) status() *statusReport {
+	now := time.Now()
+	r := &statusReport{
+		Version:         version,
+		Started:         startTime,
+		Uptime:          now.Sub(startTime).Truncate(time.Second).String(),
+		QueriesInFlight: atomic.LoadInt64(&queriesInFlight),
+		NextUpstream:    cfg.servers.next(),
+		Top:             cfg.top.report(topReported),
+		Config:          jsonMap(cfg.settings),
+	}
+
+	upstreamMu.Lock()
+	for _, server := range cfg.servers.slist {
+		s := upstreamStats[server]
+		u := upstreamStatus{Server: server, Health: s.health()}
+		if s != nil {
+			u.Queries, u.Errors, u.Timeouts = s.queries, s.errors, s.timeouts
+			u.AvgRTTMS = float64(s.avgRTT) / float64(time.Millisecond)
+			u.LastError = s.lastError
+			if !s.lastSuccess.IsZero() {
+				last := s.lastSuccess
+				u.LastSuccess = &last
+			}
+		}
+		r.Upstreams = append(r.Upstreams, u)
+	}
+	upstreamMu.Unlock()
+
+	r.Cache = cacheStatus{
+		Enabled: cfg.cache.on,
+		Entries: cfg.cache.size(),
+		Hits:    uint64(cacheHits.get()),
+		Misses:  uint64(cacheMisses.get()),
+	}
+	if total := r.Cache.Hits + r.Cache.Misses; total > 0 {
+		r.Cache.HitRatio = float64(r.Cache.Hits) / float64(total)
+	}
+	return r
+}
+
+// jsonMap converts the maps read from YAML, which may have non-string
+// keys, so they can be encoded as JSON.
+func jsonMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		out[key] = jsonValue(value)
+	}
+	return out
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return out
+	case map[string]interface{}:
+		return jsonMap(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = jsonValue(value)
+		}
+		return out
+	}
+	return v
+}
+
+// logStatus logs the runtime status, for SIGUSR2.
+func logStatus() {
+	cfg := getConfig()
+	r := cfg.status()
+	serverLog.info("status", "version", r.Version, "uptime", r.Uptime, "queries_in_flight", r.QueriesInFlight,
+		"next_upstream", r.NextUpstream)
+	for _, u := range r.Upstreams {
+		upstreamLog.info("status", "server", u.Server, "health", u.Health, "queries", u.Queries, "errors", u.Errors,
+			"timeouts", u.Timeouts, "avg_rtt_ms", fmt.Sprintf("%.1f", u.AvgRTTMS), "last_error", u.LastError)
+	}
+	cacheLog.info("status", "enabled", r.Cache.Enabled, "entries", r.Cache.Entries, "hits", r.Cache.Hits,
+		"misses", r.Cache.Misses, "hit_ratio", fmt.Sprintf("%.2f", r.Cache.HitRatio))
+	for _, list := range topLists {
+		serverLog.info("status", "top", list, "keys", formatTop(r.Top[list]))
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	cfg.dump()
+}
+
+func formatTop(list []topEntry) string {
+	parts := make([]string, len(list))
+	for i, e := range list {
+		parts[i] = fmt.Sprintf("%s=%d", e.Key, e.Count)
+	}
+	return strings.Join(parts, " ")
+}
+
+// serveStatus is the handler of /status.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	body, err := json.MarshalIndent(getConfig().status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	server := "192.0.2.53:53"
+	pruneUpstreamStats(nil)
+	if h := upstreamStats[server].health(); h != "unknown" {
+		t.Errorf("health = %s, want unknown", h)
+	}
+	recordUpstream(server, 10*time.Millisecond, nil, false)
+	for i := 0; i < upstreamDownAfter; i++ {
+		recordUpstream(server, 0, errors.New("refused"), false)
+	}
+	if h := upstreamStats[server].health(); h != "down" {
+		t.Errorf("health = %s, want down", h)
+	}
+	recordUpstream(server, 20*time.Millisecond, nil, false)
+	s := upstreamStats[server]
+	if s.health() != "up" || s.errors != upstreamDownAfter || s.avgRTT <= 10*time.Millisecond {
+		t.Errorf("unexpected state %+v", s)
+	}
+}
+
+func TestPruneUpstreamStats(t *testing.T) {
+	countUpstream("192.0.2.1:53", time.Millisecond, nil)
+	countUpstream("192.0.2.1:53", 0, errors.New("refused"))
+	countUpstream("192.0.2.2:53", time.Millisecond, nil)
+	pruneUpstreamStats([]string{"192.0.2.2:53"})
+	if upstreamStats["192.0.2.1:53"] != nil || upstreamStats["192.0.2.2:53"] == nil {
+		t.Errorf("unexpected nameservers after pruning: %v", upstreamStats)
+	}
+	var b bytes.Buffer
+	for _, m := range []metric{upstreamQueries, upstreamErrors, upstreamRTT} {
+		m.write(&b)
+	}
+	if strings.Contains(b.String(), "192.0.2.1:53") || !strings.Contains(b.String(), "192.0.2.2:53") {
+		t.Errorf("unexpected metrics after pruning:\n%s", b.String())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1', '127.0.0.2:1']
+records:
+- status.corp. 60 IN A 10.1.2.3
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Store(cfg)
+	req := new(dns.Msg)
+	req.SetQuestion("status.corp.", dns.TypeA)
+	cfg.resolve(nil, &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.7")}}, req)
+
+	rec := httptest.NewRecorder()
+	serveStatus(rec, httptest.NewRequest("GET", "/status", nil))
+	var r statusReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if r.Version != version || len(r.Upstreams) != 2 || r.NextUpstream == "" {
+		t.Errorf("unexpected status %s", rec.Body)
+	}
+	if r.Config["nameservers"] == nil {
+		t.Errorf("config missing from status %s", rec.Body)
+	}
+	if names := r.Top["names"]; len(names) != 1 || names[0].Key != "status.corp." {
+		t.Errorf("unexpected top names %v", names)
+	}
+}
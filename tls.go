@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const tlsPort = "853"
+
+// certStore holds the certificate of a DNS-over-TLS listener and the CAs
+// its clients' certificates must be signed by, if any. Files are watched
+// and loaded again when they change, so certificates can be renewed
+// without restarting.
+type certStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func newCertStore(certFile, keyFile, caFile string) (*certStore, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("cert and key are required")
+	}
+	c := &certStore{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the files again, keeping the current certificates on error.
+func (c *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", c.caFile)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.clientCAs = &cert, pool
+	return nil
+}
+
+// serverConfig returns the TLS configuration for a new connection
+// negotiating one of protos with ALPN, if any.
+func (c *certStore) serverConfig(protos ...string) *tls.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*c.cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   protos,
+	}
+	if c.clientCAs != nil {
+		config.ClientCAs = c.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// listenerTLSConfig returns the TLS configuration of the server for the
+// listener on addr. Certificates are taken from the current configuration
+// on every handshake.
+func listenerTLSConfig(addr string, protos ...string) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l := getConfig().listener(addr)
+			if l == nil || l.certs == nil {
+				return nil, fmt.Errorf("no certificate for %s", addr)
+			}
+			return l.certs.serverConfig(protos...), nil
+		},
+	}
+}
+
+// startWatch watches the certificate files for changes.
+func (c *certStore) startWatch() {
+	if c.watcher != nil {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		serverLog.error("error watching certificates", "error", err)
+		return
+	}
+	files := make(map[string]bool)
+	for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		if name == "" {
+			continue
+		}
+		files[filepath.Clean(name)] = true
+		// watch the directory to pick up files replaced by rename
+		if err := watcher.Add(filepath.Dir(name)); err != nil {
+			serverLog.error("error watching", "file", name, "error", err)
+		}
+	}
+	c.watcher, c.done = watcher, make(chan struct{})
+	go c.run(watcher, c.done, files)
+}
+
+func (c *certStore) stopWatch() {
+	if c.watcher == nil {
+		return
+	}
+	close(c.done)
+	c.watcher.Close()
+	c.watcher = nil
+}
+
+func (c *certStore) run(watcher *fsnotify.Watcher, done chan struct{}, files map[string]bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !files[filepath.Clean(event.Name)] || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := c.load(); err != nil {
+				// the key may not be written yet, the next event will retry
+				serverLog.error("error reloading certificate, keeping current one", "file", c.certFile, "error", err)
+				continue
+			}
+			serverLog.info("reloaded certificate", "file", c.certFile)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			serverLog.error("error watching certificates", "error", err)
+		}
+	}
+}
+
+// startCertWatch starts watching the certificates of every listener.
+func startCertWatch(listeners []*listener) {
+	for _, l := range listeners {
+		if l.certs != nil {
+			l.certs.startWatch()
+		}
+	}
+}
+
+func stopCertWatch(listeners []*listener) {
+	for _, l := range listeners {
+		if l.certs != nil {
+			l.certs.stopWatch()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeTestCert writes a certificate for 127.0.0.1 with the given serial,
+// signed by parent (self-signed if nil), and returns it with its key.
+func writeTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// write the certificate last, like a renewal would
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func freeTCPAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCert(t, dir, "server", 1, nil, nil)
+
+	addr := freeTCPAddr(t)
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+records:
+- db.corp. 60 IN A 10.1.2.3
+listeners:
+- address: "`+addr+`"
+  transports: [tcp-tls]
+  cert: `+filepath.Join(dir, "server.crt")+`
+  key: `+filepath.Join(dir, "server.key")+`
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer stopServers()
+	defer stopCertWatch(cfg.listeners)
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("db.corp.", dns.TypeA)
+	c := dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	r, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("unexpected answer %v", r.Answer)
+	}
+	if s := serial(); s != 1 {
+		t.Errorf("serial = %d, want 1", s)
+	}
+
+	// renewed certificates are used without restarting
+	writeTestCert(t, dir, "server", 2, nil, nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for serial() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lresolver-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", 1, nil, nil)
+	writeTestCert(t, dir, "server", 2, ca, caKey)
+	writeTestCert(t, dir, "client", 3, ca, caKey)
+
+	certs, err := newCertStore(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", certs.serverConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(config *tls.Config) error {
+		conn, err := tls.Dial("tcp", l.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// TLS 1.3 reports client certificate errors on the first read
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if err := handshake(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}); err != nil {
+		t.Errorf("client with certificate rejected: %v", err)
+	}
+	if err := handshake(&tls.Config{RootCAs: pool}); err == nil {
+		t.Error("client without certificate accepted")
+	}
+}
+
+func TestTLSListenerConfig(t *testing.T) {
+	invalid := []string{
+		"listeners: [{address: 127.0.0.1, transports: [tcp-tls]}]\n",
+		"listeners: [{address: 127.0.0.1, transports: [tcp, tcp-tls], cert: a, key: b}]\n",
+		"listeners: [{address: 127.0.0.1, cert: a, key: b}]\n",
+		"tls_bind: 127.0.0.1\ntls_cert: /nonexistent.crt\ntls_key: /nonexistent.key\n",
+	}
+	for _, yamlConfig := range invalid {
+		readTestConfig(t, yamlConfig)
+		if _, err := parseListeners(); err == nil {
+			t.Errorf("expected error for config %q", yamlConfig)
+		}
+	}
+}
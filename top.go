@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// topCounter finds the most frequent keys in a stream with bounded memory
+// using the space-saving algorithm: it counts at most capacity keys and a
+// new key replaces the least counted one, inheriting its count as the
+// possible overestimation.
+type topCounter struct {
+	capacity int
+	keys     map[string]*topEntry
+	heap     topHeap // min-heap by count
+}
+
+// topEntry is a key of a topCounter.
+type topEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error,omitempty"` // maximum overestimation of Count
+
+	index int
+}
+
+func newTopCounter(capacity int) *topCounter {
+	return &topCounter{capacity: capacity, keys: make(map[string]*topEntry)}
+}
+
+func (c *topCounter) add(key string) {
+	if e, ok := c.keys[key]; ok {
+		e.Count++
+		heap.Fix(&c.heap, e.index)
+		return
+	}
+	if len(c.heap) < c.capacity {
+		e := &topEntry{Key: key, Count: 1}
+		c.keys[key] = e
+		heap.Push(&c.heap, e)
+		return
+	}
+	e := c.heap[0]
+	delete(c.keys, e.Key)
+	e.Key, e.Error = key, e.Count
+	e.Count++
+	c.keys[key] = e
+	heap.Fix(&c.heap, 0)
+}
+
+type topHeap []*topEntry
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *topHeap) Push(x interface{}) {
+	e := x.(*topEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// windowTop counts keys over a sliding window split in topSlots slots,
+// each counted by its own topCounter; reports cover the window plus the
+// part of the current slot that has elapsed.
+type windowTop struct {
+	capacity int
+	slot     time.Duration
+
+	mu      sync.Mutex
+	slots   []*topCounter
+	pos     int
+	rotated time.Time
+}
+
+func newWindowTop(capacity int, window time.Duration) *windowTop {
+	w := &windowTop{
+		capacity: capacity,
+		slot:     window / topSlots,
+		slots:    make([]*topCounter, topSlots),
+		rotated:  time.Now(),
+	}
+	w.slots[0] = newTopCounter(capacity)
+	return w
+}
+
+// rotate moves to the slot of now, forgetting the slots that left the
+// window.
+func (w *windowTop) rotate(now time.Time) {
+	steps := int(now.Sub(w.rotated) / w.slot)
+	if steps <= 0 {
+		return
+	}
+	w.rotated = w.rotated.Add(time.Duration(steps) * w.slot)
+	if steps > len(w.slots) {
+		steps = len(w.slots)
+	}
+	for i := 0; i < steps; i++ {
+		w.pos = (w.pos + 1) % len(w.slots)
+		w.slots[w.pos] = nil
+	}
+	w.slots[w.pos] = newTopCounter(w.capacity)
+}
+
+func (w *windowTop) add(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotate(time.Now())
+	w.slots[w.pos].add(key)
+}
+
+// top returns the n most counted keys, most counted first.
+func (w *windowTop) top(n int) []topEntry {
+	w.mu.Lock()
+	w.rotate(time.Now())
+	merged := make(map[string]topEntry)
+	for _, c := range w.slots {
+		if c == nil {
+			continue
+		}
+		for key, e := range c.keys {
+			m := merged[key]
+			m.Key = key
+			m.Count += e.Count
+			m.Error += e.Error
+			merged[key] = m
+		}
+	}
+	w.mu.Unlock()
+
+	list := make([]topEntry, 0, len(merged))
+	for _, e := range merged {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+const (
+	topSlots    = 5
+	topReported = 10
+)
+
+// the lists of topStats
+var topLists = []string{"names", "clients", "nxdomain", "servfail"}
+
+// topStats tracks the most queried names, the clients with most queries
+// and the names answered with NXDOMAIN and SERVFAIL over the last
+// `top_window` seconds, counting up to `top_size` keys per list and slot.
+type topStats struct {
+	size   int
+	window time.Duration
+	lists  map[string]*windowTop
+}
+
+func newTopStats() (*topStats, error) {
+	t := &topStats{
+		size:   viper.GetInt("top_size"),
+		window: time.Duration(viper.GetInt("top_window")) * time.Second,
+		lists:  make(map[string]*windowTop),
+	}
+	if t.window < time.Second {
+		return nil, fmt.Errorf("top_window: must be at least 1, got %d", viper.GetInt("top_window"))
+	}
+	if t.size > 0 {
+		for _, list := range topLists {
+			t.lists[list] = newWindowTop(t.size, t.window)
+		}
+	}
+	return t, nil
+}
+
+// keep makes t use the counts of old when the settings didn't change, so
+// a reload doesn't reset them.
+func (t *topStats) keep(old *topStats) {
+	if old != nil && old.size == t.size && old.window == t.window {
+		t.lists = old.lists
+	}
+}
+
+// count records a client query.
+func (t *topStats) count(q *queryInfo) {
+	if t.size == 0 {
+		return
+	}
+	if ip := addrIP(q.client); ip != nil {
+		t.lists["clients"].add(ip.String())
+	}
+	if len(q.req.Question) == 0 {
+		return
+	}
+	name := strings.ToLower(q.req.Question[0].Name)
+	t.lists["names"].add(name)
+	if q.resp == nil {
+		return
+	}
+	switch q.resp.Rcode {
+	case dns.RcodeNameError:
+		t.lists["nxdomain"].add(name)
+	case dns.RcodeServerFailure:
+		t.lists["servfail"].add(name)
+	}
+}
+
+// report returns the n most counted keys of each list.
+func (t *topStats) report(n int) map[string][]topEntry {
+	r := make(map[string][]topEntry)
+	for _, list := range topLists {
+		r[list] = []topEntry{}
+		if w := t.lists[list]; w != nil {
+			r[list] = w.top(n)
+		}
+	}
+	return r
+}
+
+// topSamples returns the counts of the keys reported on /status, for
+// lresolver_top_queries.
+func topSamples() map[string]float64 {
+	samples := make(map[string]float64)
+	cfg, _ := current.Load().(*runtimeConfig)
+	if cfg == nil {
+		return samples
+	}
+	for list, entries := range cfg.top.report(topReported) {
+		for _, e := range entries {
+			samples[labelString([]string{"list", "key"}, []string{list, e.Key})] = float64(e.Count)
+		}
+	}
+	return samples
+}
+
+// serveTop is the handler of /top; the n parameter sets how many keys of
+// each list are returned.
+func serveTop(w http.ResponseWriter, r *http.Request) {
+	n := topReported
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "invalid n: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	cfg := getConfig()
+	body, err := json.MarshalIndent(struct {
+		Window string                `json:"window"`
+		Lists  map[string][]topEntry `json:"lists"`
+	}{cfg.top.window.String(), cfg.top.report(n)}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
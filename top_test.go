@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTopCounter(t *testing.T) {
+	c := newTopCounter(3)
+	for i := 0; i < 50; i++ {
+		c.add("a.")
+	}
+	// many rare keys compete for the other slots
+	for i := 0; i < 40; i++ {
+		c.add(fmt.Sprintf("rare%d.", i))
+	}
+	if len(c.keys) != 3 {
+		t.Fatalf("counting %d keys, capacity is 3", len(c.keys))
+	}
+	if e := c.keys["a."]; e == nil || e.Count != 50 || e.Error != 0 {
+		t.Errorf("frequent key lost: %+v", e)
+	}
+	if e := c.keys["rare39."]; e == nil || e.Count != e.Error+1 {
+		t.Errorf("last key not counted with its error: %+v", e)
+	}
+
+	w := newWindowTop(10, 5*time.Minute)
+	w.add("a.")
+	w.add("b.")
+	w.add("b.")
+	start := w.rotated
+	w.rotate(start.Add(4 * time.Minute))
+	w.add("a.")
+	w.add("a.")
+	top := w.top(1)
+	if len(top) != 1 || top[0].Key != "a." || top[0].Count != 3 {
+		t.Errorf("top = %v, want a.=3", top)
+	}
+	// the first slot left the window
+	w.rotate(start.Add(5 * time.Minute))
+	if top := w.top(10); len(top) != 1 || top[0].Count != 2 {
+		t.Errorf("top = %v, want a.=2", top)
+	}
+	w.rotate(start.Add(20 * time.Minute))
+	if top := w.top(10); len(top) != 0 {
+		t.Errorf("top = %v after an idle window, want none", top)
+	}
+}
+
+func TestTopStats(t *testing.T) {
+	list, err := ioutil.TempFile("", "lresolver-blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(list.Name())
+	list.WriteString("typo.corp\n")
+	list.Close()
+	readTestConfig(t, `
+nameservers: ['127.0.0.1:1']
+top_size: 10
+blocklists: ['`+list.Name()+`']
+records:
+- top.corp. 60 IN A 10.1.2.3
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Store(cfg)
+	query := func(ip, name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		cfg.resolve(nil, &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip)}}, req)
+	}
+	for i := 0; i < 3; i++ {
+		query("192.0.2.1", "top.corp.")
+	}
+	// blocked
+	query("192.0.2.2", "Typo.corp.")
+	// the nameserver is unreachable
+	query("192.0.2.2", "example.com.")
+
+	rec := httptest.NewRecorder()
+	serveTop(rec, httptest.NewRequest("GET", "/top?n=1", nil))
+	var r struct {
+		Window string
+		Lists  map[string][]topEntry
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	want := map[string]string{
+		"names":    "top.corp.",
+		"clients":  "192.0.2.1",
+		"nxdomain": "typo.corp.",
+		"servfail": "example.com.",
+	}
+	for list, key := range want {
+		if l := r.Lists[list]; len(l) != 1 || l[0].Key != key {
+			t.Errorf("top %s = %v, want %s", list, l, key)
+		}
+	}
+	if r.Window != "5m0s" {
+		t.Errorf("window = %s", r.Window)
+	}
+
+	readTestConfig(t, "nameservers: ['127.0.0.1:1']\ntop_size: 10\ntop_window: 60\n")
+	next, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.top.keep(cfg.top)
+	if len(next.top.report(10)["names"]) != 0 {
+		t.Error("counts kept after top_window changed")
+	}
+	readTestConfig(t, "nameservers: ['127.0.0.1:1']\ntop_window: 0\n")
+	if _, err := buildConfig(); err == nil {
+		t.Error("expected error for top_window 0")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// OTLP span kinds
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+const (
+	// traces sent in one request to the collector
+	tracingBatch = 100
+	// how long traces wait for a batch to fill up
+	tracingFlush = time.Second
+	// traces waiting to be sent before new ones are dropped
+	tracingQueueSize = 10000
+)
+
+// trace holds the spans of a client query: a root span for the query
+// with a child span for each step of its resolution.
+type trace struct {
+	id   [16]byte
+	root *span
+
+	mu    sync.Mutex // upstream queries may be sent in parallel
+	spans []*span
+}
+
+// span is an OTLP span.
+type span struct {
+	id     [8]byte
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  []spanAttr
+	err    string
+}
+
+type spanAttr struct {
+	key   string
+	value interface{} // string, int or bool
+}
+
+func newTrace(start time.Time) *trace {
+	t := &trace{}
+	rand.Read(t.id[:])
+	t.root = &span{name: "dns query", kind: spanServer, start: start}
+	rand.Read(t.root.id[:])
+	t.spans = []*span{t.root}
+	return t
+}
+
+// startSpan starts a child span of the root span. t may be nil, for queries
+// not traced, and so may be the span returned.
+func (t *trace) startSpan(name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+	return t.add(&span{name: name, kind: kind, start: time.Now()})
+}
+
+// add adds s as a child span of the root span.
+func (t *trace) add(s *span) *span {
+	s.parent = t.root.id
+	rand.Read(s.id[:])
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key, value})
+	}
+}
+
+func (s *span) fail(err error) {
+	if s != nil {
+		s.err = err.Error()
+	}
+}
+
+func (s *span) finish() {
+	if s != nil {
+		s.end = time.Now()
+	}
+}
+
+// tracer exports traces of one out of `tracing_sample` client queries to
+// an OpenTelemetry collector using OTLP over HTTP with JSON encoding
+// (`tracing`).
+type tracer struct {
+	endpoint string
+	service  string
+	sample   uint64
+	counter  uint64
+
+	queue   chan *trace
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newTracer() (*tracer, error) {
+	t := &tracer{
+		endpoint: viper.GetString("tracing"),
+		service:  viper.GetString("tracing_service"),
+		sample:   uint64(viper.GetInt("tracing_sample")),
+	}
+	if t.endpoint == "" {
+		return t, nil
+	}
+	if u, err := url.Parse(t.endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("tracing: invalid collector URL %q", t.endpoint)
+	}
+	if t.sample < 1 {
+		return nil, fmt.Errorf("tracing_sample: must be at least 1, got %d", t.sample)
+	}
+	return t, nil
+}
+
+func (t *tracer) enabled() bool {
+	return t.endpoint != ""
+}
+
+// keep makes t use the exporter of old when the collector didn't change.
+func (t *tracer) keep(old *tracer) {
+	if old.endpoint == t.endpoint && old.service == t.service {
+		t.queue, t.done, t.stopped = old.queue, old.done, old.stopped
+	}
+}
+
+func (t *tracer) start() {
+	if !t.enabled() || t.queue != nil {
+		return
+	}
+	t.queue = make(chan *trace, tracingQueueSize)
+	t.done = make(chan struct{})
+	t.stopped = make(chan struct{})
+	go t.run(t.queue, t.done, t.stopped)
+}
+
+// stop sends the queued traces and stops the exporter, unless cur uses it.
+func (t *tracer) stop(cur *tracer) {
+	if t.queue == nil || t.queue == cur.queue {
+		return
+	}
+	t.once.Do(func() { close(t.done) })
+	<-t.stopped
+}
+
+// newTrace returns the trace of a client query, or nil if it isn't traced.
+func (t *tracer) newTrace(start time.Time) *trace {
+	if t.queue == nil {
+		return nil
+	}
+	if t.sample > 1 && atomic.AddUint64(&t.counter, 1)%t.sample != 0 {
+		return nil
+	}
+	return newTrace(start)
+}
+
+// export queues tr, once its query is done, to be sent.
+func (t *tracer) export(tr *trace) {
+	if tr == nil {
+		return
+	}
+	select {
+	case t.queue <- tr:
+	default:
+		tracesDropped.inc()
+	}
+}
+
+func (t *tracer) run(queue chan *trace, done, stopped chan struct{}) {
+	defer close(stopped)
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(tracingFlush)
+	defer ticker.Stop()
+	var batch []*trace
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.post(client, batch); err != nil {
+			serverLog.error("tracing: error sending traces", "collector", t.endpoint, "error", err)
+			tracesDropped.add(float64(len(batch)))
+		} else {
+			tracesSent.add(float64(len(batch)))
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case tr := <-queue:
+			if batch = append(batch, tr); len(batch) >= tracingBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-done:
+			for len(queue) > 0 {
+				batch = append(batch, <-queue)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (t *tracer) post(client *http.Client, batch []*trace) error {
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %s returned %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON request, see opentelemetry/proto/trace/v1/trace.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func newOTLPAttr(key string, value interface{}) otlpAttr {
+	switch v := value.(type) {
+	case int:
+		// 64 bit integers are strings in JSON
+		return otlpAttr{key, map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case bool:
+		return otlpAttr{key, map[string]interface{}{"boolValue": v}}
+	}
+	return otlpAttr{key, map[string]interface{}{"stringValue": fmt.Sprint(value)}}
+}
+
+func (t *tracer) request(batch []*trace) *otlpRequest {
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpAttr{newOTLPAttr("service.name", t.service)}
+	ss := otlpScopeSpans{}
+	ss.Scope.Name, ss.Scope.Version = "lresolver", version
+	var zero [8]byte
+	for _, tr := range batch {
+		tr.mu.Lock()
+		for _, s := range tr.spans {
+			o := otlpSpan{
+				TraceID:           hex.EncodeToString(tr.id[:]),
+				SpanID:            hex.EncodeToString(s.id[:]),
+				Name:              s.name,
+				Kind:              s.kind,
+				StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+				EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			}
+			if s.parent != zero {
+				o.ParentSpanID = hex.EncodeToString(s.parent[:])
+			}
+			for _, a := range s.attrs {
+				o.Attributes = append(o.Attributes, newOTLPAttr(a.key, a.value))
+			}
+			if s.err != "" {
+				o.Status = &otlpStatus{Code: 2, Message: s.err}
+			}
+			ss.Spans = append(ss.Spans, o)
+		}
+		tr.mu.Unlock()
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTracing(t *testing.T) {
+	// OTLP/HTTP collector
+	var (
+		mu    sync.Mutex
+		spans []otlpSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		rs := req.ResourceSpans[0]
+		if a := rs.Resource.Attributes[0]; a.Key != "service.name" || a.Value["stringValue"] != "dns-test" {
+			t.Errorf("unexpected resource %v", a)
+		}
+		mu.Lock()
+		spans = append(spans, rs.ScopeSpans[0].Spans...)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	// upstream nameserver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{mustRR(t, req.Question[0].Name+" 60 IN A 192.0.2.10")}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	readTestConfig(t, `
+nameservers: ["`+pc.LocalAddr().String()+`"]
+tracing: `+collector.URL+`/v1/traces
+tracing_service: dns-test
+tracing_sample: 2
+`)
+	cfg, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := tracesSent.get()
+	cfg.tracer.start()
+	// the second and fourth queries are traced, the first misses the cache
+	for i := 0; i < 4; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		cfg.resolve(nil, &dohResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}, req)
+	}
+	cfg.tracer.stop(&tracer{})
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := make(map[string]int)
+	traces := make(map[string]string) // root span by trace
+	for _, s := range spans {
+		byName[s.Name]++
+		if s.ParentSpanID == "" {
+			traces[s.TraceID] = s.SpanID
+		}
+	}
+	if len(traces) != 2 {
+		t.Fatalf("got %d traces, want 2", len(traces))
+	}
+	want := map[string]int{"dns query": 2, "local records lookup": 2, "cache lookup": 2, "write response": 2}
+	for name, n := range want {
+		if byName[name] != n {
+			t.Errorf("got %d %q spans, want %d", byName[name], name, n)
+		}
+	}
+	for _, s := range spans {
+		if s.ParentSpanID != "" && s.ParentSpanID != traces[s.TraceID] {
+			t.Errorf("span %s is not a child of the root span", s.Name)
+		}
+		if s.Name == "dns query" {
+			attrs := make(map[string]interface{})
+			for _, a := range s.Attributes {
+				for _, v := range a.Value {
+					attrs[a.Key] = v
+				}
+			}
+			if attrs["dns.question.name"] != "example.com." || attrs["dns.response.code"] != "NOERROR" ||
+				attrs["lresolver.source"] != "cache" || attrs["dns.answers"] != "1" || s.Kind != spanServer {
+				t.Errorf("unexpected root span %+v", s)
+			}
+		}
+	}
+	if got := tracesSent.get() - sent; got != 2 {
+		t.Errorf("traces sent = %v, want 2", got)
+	}
+}
+
+func TestTracingUpstreamSpans(t *testing.T) {
+	tr := newTrace(time.Now())
+	q := &queryInfo{net: "udp", trace: tr}
+	m := new(dns.Msg)
+	m.Rcode = dns.RcodeNameError
+	q.addAttempt("10.0.0.1:53", time.Now(), 0, nil, errors.New("i/o timeout"))
+	q.addAttempt("10.0.0.2:53", time.Now(), 3*time.Millisecond, m, nil)
+	spans := (&tracer{service: "lresolver"}).request([]*trace{tr}).ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	if s := spans[1]; s.Kind != spanClient || s.Status == nil || s.Status.Code != 2 || s.Status.Message != "i/o timeout" {
+		t.Errorf("unexpected failed attempt span %+v", s)
+	}
+	if s := spans[2]; s.Status != nil || s.Attributes[2].Value["stringValue"] != "NXDOMAIN" {
+		t.Errorf("unexpected attempt span %+v", s)
+	}
+}